@@ -1,14 +1,21 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
+	"sync"
 	"tcp-tunnel/config"
 	"tcp-tunnel/core"
 	"tcp-tunnel/logger"
 	nets "tcp-tunnel/net"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/yymmiinngg/goargs"
 )
 
@@ -16,13 +23,42 @@ func Start(argsArr []string, log *logger.Logger) {
 	template := `
 	Usage: {{COMMAND}} CLIENT {{OPTION}}
 
-	* -s, --server-relay-address  # Request to server relay port (Format: ip:port)
+	* -s, --server-relay-address  # Request to server relay port (Format: ip:port), or the
+	#                               server bind port when visiting a secret binding
 	+ -l, --local-relay-address   # Listen on a port for Client access (Format: ip:port)
-	#                               (Default: 127.0.0.1:80)
+	#                               (Default: 127.0.0.1:80), or a unix socket file like
+	#                               "unix:///run/tcprp.sock"
+	+ -m, --socket-mode           # File permissions of the unix socket, like 0660
+	#                               (Default: by umask)
 	+ -e, --relay-encrypt-key     # Keep the relay-encrypt-key consistent with the LAN side,
 	#                               if they are not the same, correct transmission will not
-	#                               be possible
+	#                               be possible. A passphrase, or a 256-bit key like "hex:..."
+	#                               or "base64:..." (see KEYGEN), or a key file "file:<path>"
+	+     --encrypt-salt          # Salt to derive the key from the relay-encrypt-key
+	#                               passphrase, the same as the LAN side
 	+ -c, --connect-timeout       # Connection Timeout Duration (Unit: Seconds, Default: 10)
+	+ -S, --secret-name           # Visit the secret binding of the LAN side with the name
+	+ -x, --secret-key            # The key of the secret binding
+	+ -k, --bind-handshake-key    # Handshake key of the server bind port (secret binding)
+	+     --visit-key             # The visit key of the server (its --visit-key) instead of
+	#                               the bind handshake key (secret binding)
+	? -T, --tls                   # Use tls connect to the server bind port (secret binding)
+	?     --legacy-handshake      # Use the old (version 1) handshake and the old weak use of
+	#                               the relay-encrypt-key passphrase with older WAN and LAN
+	#                               versions, it can be replayed, upgrade all sides instead
+	? -g, --gateway               # Speak SOCKS5 and HTTP CONNECT on the local port for a LAN
+	#                               side in gateway mode, the requested destination is sent
+	#                               to the LAN side encrypted (relay-encrypt-key is required)
+	+ -C, --cipher                # Cipher suites accepted from the LAN side, separated by
+	#                               commas in order of preference: aes-256-gcm,
+	#                               chacha20-poly1305, xchacha20-poly1305 or none (Default:
+	#                               aes-256-gcm first on CPUs with AES instructions, otherwise
+	#                               chacha20-poly1305 first, without none; relay-encrypt-key
+	#                               is required)
+	+ -z, --compress              # Compress the relay traffic with the LAN side, which must
+	#                               set --compress too: zstd or snappy, or both in order of
+	#                               preference like "zstd,snappy" (relay-encrypt-key is
+	#                               required)
 	? -H, --help                  # Show Help and Exit
 	`
 
@@ -37,13 +73,33 @@ func Start(argsArr []string, log *logger.Logger) {
 	var localRelayAddress string
 	var serverRelayAddress string
 	var relayEncryptKey string
+	var encryptSalt string
 	var connectTimeout int
+	var gateway bool
+	var secretName, secretKey, handshakeKey string
+	var visitKey string
+	var useTls bool
+	var legacyHandshake bool
+	var compress string
+	var cipherSuite string
+	var socketMode string
 
 	// 绑定变量
 	args.StringOption("-l", &localRelayAddress, "127.0.0.1:80")
 	args.StringOption("-s", &serverRelayAddress, "")
 	args.StringOption("-e", &relayEncryptKey, "")
+	args.StringOption("--encrypt-salt", &encryptSalt, "")
 	args.IntOption("-c", &connectTimeout, 10)
+	args.BoolOption("-g", &gateway, false)
+	args.StringOption("-S", &secretName, "")
+	args.StringOption("-x", &secretKey, "")
+	args.StringOption("-k", &handshakeKey, "")
+	args.StringOption("--visit-key", &visitKey, "")
+	args.BoolOption("-T", &useTls, false)
+	args.BoolOption("--legacy-handshake", &legacyHandshake, false)
+	args.StringOption("-z", &compress, "")
+	args.StringOption("-C", &cipherSuite, "")
+	args.StringOption("-m", &socketMode, "")
 
 	// 处理参数
 	err = args.Parse(argsArr, goargs.AllowUnknowOption)
@@ -60,97 +116,410 @@ func Start(argsArr []string, log *logger.Logger) {
 		return
 	}
 
-	if connectTimeout == 0 {
-		fmt.Println("The connection timeout duration cannot be less than 1")
+	compression, err := core.ParseCompressions(compress)
+	if err != nil {
+		fmt.Println(err.Error())
 		return
 	}
-
-	// 提取tcp地址
-	serverRelayAddr, err := net.ResolveTCPAddr("tcp", serverRelayAddress)
+	cipherSuites, err := core.ParseCipherSuites(cipherSuite)
 	if err != nil {
-		fmt.Println("resolve server relay address error:", err.Error())
+		fmt.Println(err.Error())
 		return
 	}
 
-	// 提取tcp地址
-	localRelayAddr, err := net.ResolveTCPAddr("tcp", localRelayAddress)
-	if err != nil {
-		fmt.Println("resolve local relay address error:", err.Error())
-		return
+	var mode uint64
+	if socketMode != "" {
+		mode, err = strconv.ParseUint(socketMode, 8, 32)
+		if err != nil || mode > 0777 {
+			fmt.Println("bad socket mode " + socketMode)
+			return
+		}
 	}
 
-	// 本地监听器
-	localRelayListener, err := net.Listen("tcp", localRelayAddr.AddrPort().String())
+	// 创建CLIENT端
+	client, err := NewClient(Config{
+		ServerAddress:   serverRelayAddress,
+		LocalAddress:    localRelayAddress,
+		SocketMode:      os.FileMode(mode),
+		EncryptKey:      relayEncryptKey,
+		EncryptSalt:     encryptSalt,
+		ConnectTimeout:  connectTimeout,
+		Gateway:         gateway,
+		SecretName:      secretName,
+		SecretKey:       secretKey,
+		HandshakeKey:    handshakeKey,
+		VisitKey:        visitKey,
+		Tls:             useTls,
+		LegacyHandshake: legacyHandshake,
+		CipherSuites:    cipherSuites,
+		Compression:     compression,
+		Log:             log,
+	})
 	if err != nil {
-		fmt.Println("listen local relay address error:", err.Error())
+		fmt.Println(err.Error())
 		return
 	}
-	log.Debug("listen local relay address", localRelayAddr.AddrPort().String())
 
-	for {
-		localConn, err := localRelayListener.Accept()
-		if err != nil {
-			break
-		}
-		client, err := MakeClient(*serverRelayAddr, connectTimeout, relayEncryptKey, log)
-		if err != nil {
-			log.Debug("connect to server opened port error", err.Error())
-		}
-		go client.handleLocalConn(localConn)
+	if err := client.Run(context.Background()); err != nil {
+		fmt.Println(err.Error())
 	}
 }
 
+// Client CLIENT端，将本地端口的连接转发到WAN的开放端口（可解密）
 type Client struct {
-	serverAddr      net.TCPAddr
+	serverAddr net.TCPAddr
+	// *net.TCPAddr 或 *net.UnixAddr
+	localAddr       net.Addr
+	socketMode      os.FileMode
 	connectTimeout  int
 	log             *logger.Logger
-	encryptKey      string
+	encryptKey      *core.EncryptKey
 	relayHandshaker *core.Handshaker
+	// WAN验证CLIENT的证明（由加密密钥派生的密钥）
+	proofHandshaker *core.Handshaker
+	gateway         bool
+	// 可接受的加密套件及压缩方式
+	cipherSuites []string
+	compression  []string
+	// 秘密绑定
+	secretName      string
+	secretHandshake *core.Handshaker
+	bindHandshake   *core.Handshaker
+	useTls          bool
+	events          Events
+	// 本地监听器及正在转发的连接
+	listener  net.Listener
+	sessions  *core.SyncMap
+	lock      sync.Locker
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func MakeClient(serverAddr net.TCPAddr, connectTimeout int, encryptKey string, log *logger.Logger) (*Client, error) {
+// NewClient 按配置创建CLIENT端，调用Run开始监听
+func NewClient(config Config) (*Client, error) {
+	serverAddr, localAddr, err := config.check()
+	if err != nil {
+		return nil, err
+	}
+	log := config.Log
+	if log == nil {
+		log = logger.NewLogger("CLIENT", logger.LevelInfo, nil)
+	}
+	// 加密密钥（口令派生耗时，只派生一次）
+	var encryptKey *core.EncryptKey
+	if config.EncryptKey != "" {
+		encryptKey, err = core.ParseEncryptKey(config.EncryptKey, config.EncryptSalt, config.LegacyHandshake)
+		if err != nil {
+			return nil, &core.ConfigError{Field: "EncryptKey", Message: err.Error()}
+		}
+	}
 	return &Client{
-		serverAddr:     serverAddr,
-		connectTimeout: connectTimeout,
+		serverAddr:     *serverAddr,
+		localAddr:      localAddr,
+		socketMode:     config.SocketMode,
+		connectTimeout: config.ConnectTimeout,
 		log:            log,
 		encryptKey:     encryptKey,
 		relayHandshaker: func() *core.Handshaker {
-			if encryptKey != "" {
-				return core.MakeHandshaker(encryptKey)
+			if encryptKey != nil {
+				return core.MakeHandshaker(encryptKey.HandshakeKey(), config.LegacyHandshake)
+			}
+			return nil
+		}(),
+		proofHandshaker: func() *core.Handshaker {
+			if encryptKey != nil {
+				return core.MakeProofHandshaker(encryptKey.ProofKey())
+			}
+			return nil
+		}(),
+		gateway: config.Gateway,
+		cipherSuites: func() []string {
+			if encryptKey != nil && len(config.CipherSuites) == 0 {
+				return core.DefaultCipherSuites()
+			}
+			return config.CipherSuites
+		}(),
+		compression: config.Compression,
+		secretName:  config.SecretName,
+		secretHandshake: func() *core.Handshaker {
+			if config.SecretKey != "" {
+				return core.MakeHandshaker(config.SecretKey, config.LegacyHandshake)
 			}
 			return nil
 		}(),
+		bindHandshake: func() *core.Handshaker {
+			// 访问者只有访问密钥，由WAN的confirm验证WAN
+			if config.VisitKey != "" {
+				return core.MakeHandshaker(config.VisitKey, false)
+			}
+			return core.MakeHandshaker(config.HandshakeKey, config.LegacyHandshake)
+		}(),
+		useTls:   config.Tls,
+		events:   config.Events,
+		sessions: core.MakeSyncMap(16),
+		lock:     &sync.Mutex{},
+		done:     make(chan struct{}),
 	}, nil
 }
 
+// Run 监听本地端口并转发，直到ctx取消或调用Close
+// 返回 ctx.Err()、core.ErrClosed 或监听错误
+func (it *Client) Run(ctx context.Context) error {
+	// 本地监听器
+	localRelayListener, err := it.listen()
+	if err != nil {
+		return &core.ListenError{Address: it.localAddr.String(), Err: err}
+	}
+	it.log.Debug("listen local relay address", it.localAddr.String())
+
+	// 关闭后不再服务
+	it.lock.Lock()
+	if it.isClosed() {
+		it.lock.Unlock()
+		localRelayListener.Close()
+		return core.ErrClosed
+	}
+	it.listener = localRelayListener
+	it.lock.Unlock()
+
+	// ctx取消时关闭
+	go func() {
+		select {
+		case <-ctx.Done():
+			it.Close()
+		case <-it.done:
+		}
+	}()
+
+	defer localRelayListener.Close()
+	for {
+		localConn, err := localRelayListener.Accept()
+		if err != nil {
+			if !it.isClosed() {
+				it.Close()
+				return err
+			}
+			break
+		}
+		go it.handleLocalConn(localConn)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return core.ErrClosed
+}
+
+// Close 关闭本地监听及正在转发的连接
+func (it *Client) Close() error {
+	it.closeOnce.Do(func() {
+		close(it.done)
+		it.lock.Lock()
+		if it.listener != nil {
+			it.listener.Close()
+		}
+		it.lock.Unlock()
+		it.sessions.Range(func(key, value interface{}) bool {
+			key.(net.Conn).Close()
+			return true
+		})
+	})
+	return nil
+}
+
+// 监听本地TCP端口或unix socket
+func (it *Client) listen() (net.Listener, error) {
+	if it.localAddr.Network() == "unix" {
+		return nets.ListenUnix(it.localAddr.String(), it.socketMode)
+	}
+	return net.Listen("tcp", it.localAddr.String())
+}
+
+func (it *Client) isClosed() bool {
+	select {
+	case <-it.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (it *Client) handleLocalConn(localConn net.Conn) {
+	it.sessions.Put(localConn, true)
+	defer it.sessions.Delete(localConn)
 	defer localConn.Close()
-	serverConn, err := net.DialTimeout("tcp", it.serverAddr.AddrPort().String(), time.Duration(it.connectTimeout)*time.Second)
+	record := &logger.AccessRecord{
+		SessionID:     uuid.New().String(),
+		OpenPort:      it.openPort(),
+		ClientAddress: localConn.RemoteAddr().String(),
+		StartTime:     time.Now(),
+		Encrypted:     it.encryptKey != nil,
+	}
+	log := it.log.With("session", record.SessionID)
+
+	// 网关模式：先读取用户的代理请求
+	var proxyRequest *nets.ProxyRequest
+	if it.gateway {
+		var err error
+		proxyRequest, err = nets.AcceptProxy(localConn, config.WaitTimeout)
+		if err != nil {
+			log.Debug("accept proxy request error:", err.Error())
+			return
+		}
+		record.Destination = proxyRequest.Address
+	}
+
+	serverConn, err := it.connectServer()
 	if err != nil {
-		it.log.Debug("connect to server opened port error", err.Error())
+		log.Debug("connect to server opened port error", err.Error())
+		if proxyRequest != nil {
+			proxyRequest.Reply(err.Error())
+		}
 		return
 	}
 	defer func() {
 		serverConn.Close()
-		it.log.Debug("break", localConn.RemoteAddr().String(), "</>", serverConn.RemoteAddr().String())
+		log.Debug("break", localConn.RemoteAddr().String(), "</>", serverConn.RemoteAddr().String())
 	}()
 
 	// 开始转发
-	it.log.Debug("relay", localConn.RemoteAddr().String(), "<->", serverConn.RemoteAddr().String())
+	log.Debug("relay", localConn.RemoteAddr().String(), "<->", serverConn.RemoteAddr().String())
 	// 加解密处理器
 	var cryptor core.Cryptor
-	if it.encryptKey != "" {
-		cryptor, err = core.NewXChaCha20Crypto(it.encryptKey)
+	if it.encryptKey != nil {
+		// WAN对CLIENT的验证（旧版本的WAN或LAN没有），之后为LAN的加密握手
+		handshaker, controlConn, err := core.RwControlHandshakeAny(serverConn, config.WaitTimeout, it.proofHandshaker, it.relayHandshaker)
+		if err == nil && handshaker == it.proofHandshaker {
+			controlConn, err = it.relayHandshaker.RwControlHandshake(serverConn, config.WaitTimeout)
+		}
+		if err != nil {
+			log.Debug("relay handshake error:", err.Error())
+			return
+		}
+		// 经控制连接协商加密套件（旧版本的握手不协商）
+		suite := core.CipherChaCha20
+		if controlConn.Encrypted() {
+			suite, err = nets.AcceptCipherSuite(controlConn, it.cipherSuites, config.WaitTimeout)
+			if err != nil {
+				log.Debug("negotiate cipher suite error:", err.Error())
+				return
+			}
+		}
+		cryptor, err = it.encryptKey.NewCryptor(suite, controlConn)
+		if err != nil {
+			log.Debug("make cryptor error", err.Error())
+			return
+		}
+		record.Encrypted = cryptor != nil
+		record.Cipher = suite
+	}
+
+	// 协商压缩方式
+	var compressor core.Compressor
+	if len(it.compression) > 0 {
+		compressor, err = nets.AcceptCompression(nets.NewCryptConn(serverConn, cryptor), it.compression, config.WaitTimeout)
 		if err != nil {
-			it.log.Debug("make cryptor error", err.Error())
+			log.Debug("negotiate compression error:", err.Error())
 			return
 		}
-		// 加密连接的握手
-		err = it.relayHandshaker.RwHandshake(serverConn, config.WaitTimeout)
+		if compressor != nil {
+			defer compressor.Close()
+			record.Compression = compressor.Name()
+		}
+	}
+
+	// 网关模式：经加密的连接请求LAN连接目标
+	if proxyRequest != nil {
+		message, err := nets.RequestDial(nets.NewCryptConn(serverConn, cryptor), proxyRequest.Address, config.WaitTimeout)
 		if err != nil {
-			it.log.Debug("relay handshake error:", err.Error())
+			log.Debug("request gateway dial error:", err.Error())
+			proxyRequest.Reply(err.Error())
 			return
 		}
+		proxyRequest.Reply(message)
+		if message != "success" {
+			log.Debug("gateway dial", proxyRequest.Address, "error:", message)
+			record.CloseReason = "gateway " + message
+			it.access(record)
+			return
+		}
+	}
+	stats := nets.Relay(localConn, serverConn, 0, cryptor, compressor)
+
+	// 访问记录
+	record.BytesFromClient = stats.Plain12
+	record.BytesToClient = stats.Bytes21
+	if compressor != nil {
+		record.CompressRatio = stats.CompressRatio()
+	}
+	record.CloseReason = stats.CloseReason("client", "server")
+	it.access(record)
+}
+
+// 访问的开放端口或秘密绑定
+func (it *Client) openPort() string {
+	if it.secretHandshake != nil {
+		return core.SecretBindingPrefix + it.secretName
+	}
+	return it.serverAddr.String()
+}
+
+// 连接WAN的开放端口，秘密绑定时经绑定端口访问并验证密钥
+func (it *Client) connectServer() (net.Conn, error) {
+	d := &net.Dialer{Timeout: time.Duration(it.connectTimeout) * time.Second}
+	if it.secretHandshake == nil {
+		return d.Dial("tcp", it.serverAddr.AddrPort().String())
+	}
+
+	var serverConn net.Conn
+	var err error
+	if it.useTls {
+		serverConn, err = tls.DialWithDialer(d, "tcp", it.serverAddr.AddrPort().String(), &tls.Config{InsecureSkipVerify: true})
+	} else {
+		serverConn, err = d.Dial("tcp", it.serverAddr.AddrPort().String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := it.visit(serverConn); err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+	return serverConn, nil
+}
+
+// 访问秘密绑定：绑定端口的握手、访问请求（经控制连接）、秘密绑定的握手
+func (it *Client) visit(serverConn net.Conn) error {
+	controlConn, err := it.bindHandshake.RwControlHandshake(serverConn, config.WaitTimeout)
+	if err != nil {
+		return fmt.Errorf("bind handshake error: %s", err.Error())
+	}
+	if err := core.WriteObject2Json(controlConn, &core.VisitRequest{
+		Reqeust:    core.Reqeust{Action: "visit"},
+		SecretName: it.secretName,
+	}); err != nil {
+		return err
+	}
+	serverConn.SetReadDeadline(time.Now().Add(time.Duration(config.WaitTimeout) * time.Second))
+	response := &core.Response{}
+	err = core.ReadJson2Object(controlConn, response)
+	serverConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	if response.Message != "success" {
+		return errors.New(response.Message)
+	}
+	if err := it.secretHandshake.RwHandshake(serverConn, config.WaitTimeout); err != nil {
+		return fmt.Errorf("secret handshake error: %s", err.Error())
+	}
+	return nil
+}
+
+// 输出访问记录
+func (it *Client) access(record *logger.AccessRecord) {
+	record.EndTime = time.Now()
+	it.log.Access(record)
+	if it.events.OnSession != nil {
+		it.events.OnSession(record)
 	}
-	nets.Relay(localConn, serverConn, 0, cryptor)
 }
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"net"
+	"os"
+	"tcp-tunnel/core"
+	"tcp-tunnel/logger"
+	nets "tcp-tunnel/net"
+)
+
+// Config CLIENT端的配置
+type Config struct {
+	// WAN的开放端口，如 "1.1.1.1:80"，访问秘密绑定时为WAN的绑定端口
+	ServerAddress string
+	// 本地监听地址，如 "127.0.0.1:80" 或 "unix:///run/tcprp.sock"
+	LocalAddress string
+	// 本地unix socket文件的权限，如 0660，0为默认（受umask影响）
+	SocketMode os.FileMode
+	// 与LAN端一致的加密密钥，为空时不解密：口令，或 "hex:"、"base64:" 开头的256位密钥，
+	// 或 "file:" 开头的密钥文件
+	EncryptKey string
+	// 口令派生加密密钥的盐，与LAN端一致，为空时使用默认的盐
+	EncryptSalt string
+	// 连接超时（单位：秒）
+	ConnectTimeout int
+	// 访问秘密绑定的名称及密钥
+	SecretName string
+	SecretKey  string
+	// 访问秘密绑定时，WAN绑定端口的握手密钥及是否使用TLS
+	HandshakeKey string
+	Tls          bool
+	// WAN的访问密钥（代替握手密钥，WAN的 --visit-key），设置时不需要握手密钥
+	VisitKey string
+	// 使用旧版本（版本1）的握手及加密口令的使用方式，兼容旧版本的WAN及LAN（可被重放）
+	LegacyHandshake bool
+	// 网关模式：本地端口处理SOCKS5及HTTP CONNECT请求，目标经加密的连接发送给LAN
+	Gateway bool
+	// 可接受的加密套件（见 core.CipherSuiteNames），按优先顺序，为空时为 core.DefaultCipherSuites（需要EncryptKey）
+	CipherSuites []string
+	// 可接受的压缩方式（zstd、snappy），按优先顺序，LAN端须同样设置（需要EncryptKey）
+	Compression []string
+	// 日志，为空时不输出
+	Log *logger.Logger
+	// 事件回调
+	Events
+}
+
+// Events 事件回调，均可为空，回调中不应阻塞
+type Events struct {
+	// 一次转发会话结束
+	OnSession func(record *logger.AccessRecord)
+}
+
+// DefaultConfig 默认配置（与命令行的默认值一致）
+func DefaultConfig() Config {
+	return Config{
+		LocalAddress:   "127.0.0.1:80",
+		ConnectTimeout: 10,
+	}
+}
+
+// 检查配置，返回WAN及本地地址
+func (it *Config) check() (*net.TCPAddr, net.Addr, error) {
+	if it.ConnectTimeout < 1 {
+		return nil, nil, &core.ConfigError{Field: "ConnectTimeout", Message: "The connection timeout duration cannot be less than 1"}
+	}
+
+	if (it.SecretName == "") != (it.SecretKey == "") {
+		return nil, nil, &core.ConfigError{Field: "SecretName", Message: "secret name and secret key must be pair"}
+	}
+
+	if it.VisitKey != "" && it.LegacyHandshake {
+		return nil, nil, &core.ConfigError{Field: "VisitKey", Message: "The visit key can not be used with the legacy handshake"}
+	}
+
+	if it.Gateway && it.EncryptKey == "" {
+		return nil, nil, &core.ConfigError{Field: "Gateway", Message: "In gateway mode, the relay encrypt key is mandatory"}
+	}
+
+	if len(it.CipherSuites) > 0 && it.EncryptKey == "" {
+		return nil, nil, &core.ConfigError{Field: "CipherSuites", Message: "The cipher suites require the relay encrypt key"}
+	}
+	for _, suite := range it.CipherSuites {
+		if core.GetCipherSuite(suite) == nil {
+			return nil, nil, &core.ConfigError{Field: "CipherSuites", Message: "Unknow cipher suite " + suite}
+		}
+	}
+
+	if len(it.Compression) > 0 && it.EncryptKey == "" {
+		return nil, nil, &core.ConfigError{Field: "Compression", Message: "The compression requires the relay encrypt key"}
+	}
+	for _, method := range it.Compression {
+		if !core.IsCompression(method) {
+			return nil, nil, &core.ConfigError{Field: "Compression", Message: "Unknow compression " + method}
+		}
+	}
+
+	// 提取tcp地址
+	serverRelayAddr, err := net.ResolveTCPAddr("tcp", it.ServerAddress)
+	if err != nil {
+		return nil, nil, &core.ConfigError{Field: "ServerAddress", Message: "resolve server relay address error: " + err.Error()}
+	}
+
+	// 提取tcp或unix socket地址
+	localRelayAddr, err := nets.ResolveAddr(it.LocalAddress)
+	if err != nil {
+		return nil, nil, &core.ConfigError{Field: "LocalAddress", Message: "resolve local relay address error: " + err.Error()}
+	}
+	return serverRelayAddr, localRelayAddr, nil
+}
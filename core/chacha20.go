@@ -13,10 +13,14 @@ const (
 	KeySize256 int = 32
 )
 
-// Cryptor 加解密接口
+// Cryptor 转发流量的加解密处理器，按连接创建，由加密套件（见CipherSuite）决定
 type Cryptor interface {
-	Encrypt(src, dest []byte)
-	Decrypt(src, dest []byte)
+	// Name 加密套件，如 "aes-256-gcm"
+	Name() string
+	// Encrypt 加密一段数据（AEAD套件为一帧或多帧）
+	Encrypt(src []byte) []byte
+	// Decrypt 输入收到的数据，返回其中完整帧解密后的数据，不完整的帧留待下次输入
+	Decrypt(src []byte) ([]byte, error)
 }
 
 // toCryptKey toCryptKey
@@ -37,18 +41,27 @@ type ChaCha20Cryptor struct {
 	deLocker sync.Mutex
 }
 
+// Name Name
+func (c *ChaCha20Cryptor) Name() string {
+	return CipherChaCha20
+}
+
 // Encrypt Encrypt
-func (c *ChaCha20Cryptor) Encrypt(src, dest []byte) {
+func (c *ChaCha20Cryptor) Encrypt(src []byte) []byte {
 	c.enLocker.Lock()
 	defer c.enLocker.Unlock()
+	dest := make([]byte, len(src))
 	c.enCipher.XORKeyStream(dest, src)
+	return dest
 }
 
 // Decrypt Decrypt
-func (c *ChaCha20Cryptor) Decrypt(src, dest []byte) {
+func (c *ChaCha20Cryptor) Decrypt(src []byte) ([]byte, error) {
 	c.deLocker.Lock()
 	defer c.deLocker.Unlock()
+	dest := make([]byte, len(src))
 	c.deCipher.XORKeyStream(dest, src)
+	return dest, nil
 }
 
 // NewXChaCha20Crypto NewXChaCha20Crypto
@@ -59,11 +72,11 @@ func NewXChaCha20Crypto(key string) (*ChaCha20Cryptor, error) {
 
 // NewChaCha20Crypto NewChaCha20Crypto
 func newChaCha20Crypto(key string) (*ChaCha20Cryptor, error) {
-	var enCipher, deCipher *chacha20.Cipher
-	var err error
 	h := md5.New()
 	io.WriteString(h, "2e8fvx6zbyf40ut"+key)
 	iv := h.Sum(nil)[:12]
+	var enCipher, deCipher *chacha20.Cipher
+	var err error
 	enCipher, err = chacha20.NewUnauthenticatedCipher([]byte(key), iv)
 	if err != nil {
 		return nil, err
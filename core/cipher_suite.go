@@ -0,0 +1,192 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// 转发流量的加密套件
+const (
+	CipherNone              = "none"
+	CipherChaCha20Poly1305  = "chacha20-poly1305"
+	CipherAes256Gcm         = "aes-256-gcm"
+	CipherXChaCha20Poly1305 = "xchacha20-poly1305"
+	// CipherChaCha20 旧版本的ChaCha20流加密（无认证），只用于兼容旧版本，不能协商
+	CipherChaCha20 = "chacha20"
+)
+
+// 帧头：4字节密文长度
+const (
+	cipherHeaderSize = 4
+	// 单帧的最大明文长度
+	cipherMaxFrame = 16 * 1024
+)
+
+// CipherSuite 转发流量的加密套件，按名称注册，LAN提供、CLIENT选择
+type CipherSuite struct {
+	Name string
+	// 由256位密钥创建AEAD，为空时不加密
+	NewAead func(key []byte) (cipher.AEAD, error)
+}
+
+var cipherSuites = map[string]*CipherSuite{}
+var cipherSuitesLock sync.RWMutex
+
+func init() {
+	RegisterCipherSuite(&CipherSuite{Name: CipherNone})
+	RegisterCipherSuite(&CipherSuite{Name: CipherChaCha20Poly1305, NewAead: chacha20poly1305.New})
+	RegisterCipherSuite(&CipherSuite{Name: CipherXChaCha20Poly1305, NewAead: chacha20poly1305.NewX})
+	RegisterCipherSuite(&CipherSuite{Name: CipherAes256Gcm, NewAead: func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}})
+}
+
+// RegisterCipherSuite 注册加密套件，同名的套件被替换
+func RegisterCipherSuite(suite *CipherSuite) {
+	cipherSuitesLock.Lock()
+	defer cipherSuitesLock.Unlock()
+	cipherSuites[suite.Name] = suite
+}
+
+// GetCipherSuite 按名称获取加密套件，不存在时为空
+func GetCipherSuite(name string) *CipherSuite {
+	cipherSuitesLock.RLock()
+	defer cipherSuitesLock.RUnlock()
+	return cipherSuites[name]
+}
+
+// CipherSuiteNames 已注册的加密套件名称
+func CipherSuiteNames() []string {
+	cipherSuitesLock.RLock()
+	defer cipherSuitesLock.RUnlock()
+	names := make([]string, 0, len(cipherSuites))
+	for name := range cipherSuites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseCipherSuites 解析逗号分隔的加密套件，如 "aes-256-gcm,chacha20-poly1305"
+func ParseCipherSuites(text string) ([]string, error) {
+	suites := []string{}
+	for _, suite := range strings.Split(text, ",") {
+		suite = strings.TrimSpace(suite)
+		if suite == "" {
+			continue
+		}
+		if GetCipherSuite(suite) == nil {
+			return nil, fmt.Errorf("unknow cipher suite %s", suite)
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// DefaultCipherSuites 默认的加密套件（按优先顺序），CPU支持AES指令时优先AES-GCM，不包含none
+func DefaultCipherSuites() []string {
+	hasAes := (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) ||
+		(runtime.GOARCH == "arm64" && cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) ||
+		(runtime.GOARCH == "s390x" && cpu.S390X.HasAES && cpu.S390X.HasGHASH)
+	if hasAes {
+		return []string{CipherAes256Gcm, CipherChaCha20Poly1305, CipherXChaCha20Poly1305}
+	}
+	return []string{CipherChaCha20Poly1305, CipherXChaCha20Poly1305, CipherAes256Gcm}
+}
+
+// 按帧加密及认证：长度(4) | AEAD密文，每个方向各一个密钥，nonce为帧序号
+type aeadCryptor struct {
+	name     string
+	sealer   cipher.AEAD
+	opener   cipher.AEAD
+	writeSeq uint64
+	readSeq  uint64
+	enLocker sync.Mutex
+	deLocker sync.Mutex
+	// 未完整的帧
+	pending []byte
+}
+
+func newAeadCryptor(suite *CipherSuite, sendKey []byte, receiveKey []byte) (*aeadCryptor, error) {
+	sealer, err := suite.NewAead(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := suite.NewAead(receiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadCryptor{name: suite.Name, sealer: sealer, opener: opener}, nil
+}
+
+func aeadNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (it *aeadCryptor) Name() string {
+	return it.name
+}
+
+func (it *aeadCryptor) Encrypt(src []byte) []byte {
+	it.enLocker.Lock()
+	defer it.enLocker.Unlock()
+	var dest []byte
+	for len(src) > 0 || dest == nil {
+		size := len(src)
+		if size > cipherMaxFrame {
+			size = cipherMaxFrame
+		}
+		start := len(dest)
+		dest = append(dest, make([]byte, cipherHeaderSize)...)
+		dest = it.sealer.Seal(dest, aeadNonce(it.sealer, it.writeSeq), src[:size], nil)
+		binary.BigEndian.PutUint32(dest[start:], uint32(len(dest)-start-cipherHeaderSize))
+		it.writeSeq++
+		src = src[size:]
+	}
+	return dest
+}
+
+func (it *aeadCryptor) Decrypt(src []byte) ([]byte, error) {
+	it.deLocker.Lock()
+	defer it.deLocker.Unlock()
+	it.pending = append(it.pending, src...)
+	var dest []byte
+	for len(it.pending) >= cipherHeaderSize {
+		size := int(binary.BigEndian.Uint32(it.pending))
+		if size > cipherMaxFrame+it.opener.Overhead() {
+			return nil, errors.New("encrypted frame too large")
+		}
+		if len(it.pending) < cipherHeaderSize+size {
+			break
+		}
+		frame := it.pending[cipherHeaderSize : cipherHeaderSize+size]
+		plain, err := it.opener.Open(dest, aeadNonce(it.opener, it.readSeq), frame, nil)
+		if err != nil {
+			return nil, errors.New("encrypted frame not authenticated")
+		}
+		dest = plain
+		it.readSeq++
+		it.pending = it.pending[cipherHeaderSize+size:]
+	}
+	// 释放已处理的部分
+	if len(it.pending) == 0 {
+		it.pending = nil
+	}
+	return dest, nil
+}
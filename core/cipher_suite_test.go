@@ -0,0 +1,123 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// 加密套件的一对加解密器（发送方及接收方）
+func aeadCryptorPair(t *testing.T, name string) (*aeadCryptor, *aeadCryptor) {
+	suite := GetCipherSuite(name)
+	if suite == nil {
+		t.Fatalf("cipher suite %s not registered", name)
+	}
+	sendKey := bytes.Repeat([]byte{1}, KeySize256)
+	receiveKey := bytes.Repeat([]byte{2}, KeySize256)
+	sender, err := newAeadCryptor(suite, sendKey, receiveKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := newAeadCryptor(suite, receiveKey, sendKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, receiver
+}
+
+var aeadSuites = []string{CipherChaCha20Poly1305, CipherXChaCha20Poly1305, CipherAes256Gcm}
+
+func TestCipherSuiteRoundTrip(t *testing.T) {
+	for _, name := range aeadSuites {
+		sender, receiver := aeadCryptorPair(t, name)
+		if sender.Name() != name {
+			t.Fatalf("cryptor name %s, expected %s", sender.Name(), name)
+		}
+		messages := [][]byte{[]byte("hello"), bytes.Repeat([]byte("x"), cipherMaxFrame*2+100), []byte("world")}
+		var stream []byte
+		for _, message := range messages {
+			stream = append(stream, sender.Encrypt(message)...)
+		}
+		// 分成不完整的段输入
+		var received []byte
+		for len(stream) > 0 {
+			size := 1000
+			if size > len(stream) {
+				size = len(stream)
+			}
+			plain, err := receiver.Decrypt(stream[:size])
+			if err != nil {
+				t.Fatalf("%s decrypt error: %v", name, err)
+			}
+			received = append(received, plain...)
+			stream = stream[size:]
+		}
+		if !bytes.Equal(received, bytes.Join(messages, nil)) {
+			t.Fatalf("%s round trip not match", name)
+		}
+	}
+}
+
+func TestCipherSuiteTampered(t *testing.T) {
+	for _, name := range aeadSuites {
+		sender, receiver := aeadCryptorPair(t, name)
+		frame := sender.Encrypt([]byte("hello world"))
+		frame[len(frame)-1] ^= 0x01
+		_, err := receiver.Decrypt(frame)
+		if err == nil || !strings.Contains(err.Error(), "not authenticated") {
+			t.Fatalf("%s tampered frame error %v, expected not authenticated", name, err)
+		}
+	}
+}
+
+func TestCipherSuiteReplayed(t *testing.T) {
+	sender, receiver := aeadCryptorPair(t, CipherChaCha20Poly1305)
+	frame := sender.Encrypt([]byte("hello"))
+	if _, err := receiver.Decrypt(frame); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Decrypt(frame); err == nil {
+		t.Fatal("replayed frame should not be authenticated")
+	}
+}
+
+func TestCipherSuiteOversizeFrame(t *testing.T) {
+	_, receiver := aeadCryptorPair(t, CipherChaCha20Poly1305)
+	header := make([]byte, cipherHeaderSize)
+	binary.BigEndian.PutUint32(header, cipherMaxFrame*2)
+	_, err := receiver.Decrypt(header)
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("oversize frame error %v, expected too large", err)
+	}
+}
+
+func TestCipherSuiteEmptyWrite(t *testing.T) {
+	sender, receiver := aeadCryptorPair(t, CipherAes256Gcm)
+	plain, err := receiver.Decrypt(sender.Encrypt(nil))
+	if err != nil || len(plain) != 0 {
+		t.Fatalf("empty frame: %q, %v", plain, err)
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites(" aes-256-gcm, none ,,chacha20-poly1305")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(suites, ",") != "aes-256-gcm,none,chacha20-poly1305" {
+		t.Fatalf("unexpected suites %v", suites)
+	}
+	if _, err := ParseCipherSuites("aes-256-gcm,rc4"); err == nil {
+		t.Fatal("unknow cipher suite should fail")
+	}
+	// 旧版本的流加密不能协商
+	if _, err := ParseCipherSuites(CipherChaCha20); err == nil {
+		t.Fatal("the legacy chacha20 should not be negotiable")
+	}
+	for _, suite := range DefaultCipherSuites() {
+		if suite == CipherNone {
+			t.Fatal("the default cipher suites should not contain none")
+		}
+	}
+}
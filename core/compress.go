@@ -0,0 +1,169 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// CompressZstd zstd压缩（压缩率高）
+	CompressZstd = "zstd"
+	// CompressSnappy snappy压缩（速度快）
+	CompressSnappy = "snappy"
+	// CompressNone 不压缩（协商结果）
+	CompressNone = "none"
+)
+
+// 帧头：1字节类型 + 4字节长度
+const (
+	compressFrameRaw        = 0
+	compressFrameCompressed = 1
+	compressHeaderSize      = 5
+	// 单帧的最大长度（压缩前后）
+	compressMaxFrame = 1024 * 1024
+)
+
+// Compressor 转发流量的压缩处理器，按连接创建，与Cryptor一样在Relay中处理每段数据
+type Compressor interface {
+	// Name 压缩方式，如 "zstd"
+	Name() string
+	// Compress 将一段数据压缩为一帧
+	Compress(src []byte) []byte
+	// Decompress 输入收到的数据，返回其中完整帧解压后的数据，不完整的帧留待下次输入
+	Decompress(src []byte) ([]byte, error)
+	// Close 释放压缩的资源，转发结束后调用
+	Close()
+}
+
+// IsCompression 是否为支持的压缩方式
+func IsCompression(method string) bool {
+	return method == CompressZstd || method == CompressSnappy
+}
+
+// ParseCompressions 解析逗号分隔的压缩方式，如 "zstd,snappy"
+func ParseCompressions(text string) ([]string, error) {
+	methods := []string{}
+	for _, method := range strings.Split(text, ",") {
+		method = strings.TrimSpace(method)
+		if method == "" {
+			continue
+		}
+		if !IsCompression(method) {
+			return nil, fmt.Errorf("unknow compression %s", method)
+		}
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
+
+// NewCompressor 创建压缩处理器
+func NewCompressor(method string) (Compressor, error) {
+	switch method {
+	case CompressZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(compressMaxFrame))
+		if err != nil {
+			encoder.Close()
+			return nil, err
+		}
+		return &frameCompressor{
+			name:       method,
+			compress:   func(src []byte) []byte { return encoder.EncodeAll(src, nil) },
+			decompress: func(src []byte) ([]byte, error) { return decoder.DecodeAll(src, nil) },
+			close: func() {
+				encoder.Close()
+				decoder.Close()
+			},
+		}, nil
+	case CompressSnappy:
+		return &frameCompressor{
+			name:     method,
+			compress: func(src []byte) []byte { return snappy.Encode(nil, src) },
+			decompress: func(src []byte) ([]byte, error) {
+				size, err := snappy.DecodedLen(src)
+				if err != nil {
+					return nil, err
+				}
+				if size > compressMaxFrame {
+					return nil, errors.New("compressed frame too large")
+				}
+				return snappy.Decode(nil, src)
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknow compression %s", method)
+}
+
+// 按帧压缩，压缩后不变小的数据原样发送
+type frameCompressor struct {
+	name       string
+	compress   func(src []byte) []byte
+	decompress func(src []byte) ([]byte, error)
+	// 释放资源，为空时无需释放
+	close func()
+	// 未完整的帧
+	pending []byte
+}
+
+func (it *frameCompressor) Name() string {
+	return it.name
+}
+
+func (it *frameCompressor) Close() {
+	if it.close != nil {
+		it.close()
+	}
+}
+
+func (it *frameCompressor) Compress(src []byte) []byte {
+	frameType := byte(compressFrameCompressed)
+	payload := it.compress(src)
+	if len(payload) >= len(src) {
+		frameType, payload = compressFrameRaw, src
+	}
+	frame := make([]byte, compressHeaderSize, compressHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func (it *frameCompressor) Decompress(src []byte) ([]byte, error) {
+	it.pending = append(it.pending, src...)
+	var dest []byte
+	for len(it.pending) >= compressHeaderSize {
+		size := int(binary.BigEndian.Uint32(it.pending[1:compressHeaderSize]))
+		if size > compressMaxFrame {
+			return nil, errors.New("compressed frame too large")
+		}
+		if len(it.pending) < compressHeaderSize+size {
+			break
+		}
+		payload := it.pending[compressHeaderSize : compressHeaderSize+size]
+		switch it.pending[0] {
+		case compressFrameRaw:
+			dest = append(dest, payload...)
+		case compressFrameCompressed:
+			data, err := it.decompress(payload)
+			if err != nil {
+				return nil, err
+			}
+			dest = append(dest, data...)
+		default:
+			return nil, fmt.Errorf("unknow compressed frame type %d", it.pending[0])
+		}
+		it.pending = it.pending[compressHeaderSize+size:]
+	}
+	// 释放已处理的部分
+	if len(it.pending) == 0 {
+		it.pending = nil
+	}
+	return dest, nil
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestCompressorRoundTrip(t *testing.T) {
+	for _, method := range []string{CompressZstd, CompressSnappy} {
+		compressor, err := NewCompressor(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressor, _ := NewCompressor(method)
+		defer compressor.Close()
+		defer decompressor.Close()
+		random, _ := RandBytes(4096)
+		messages := [][]byte{bytes.Repeat([]byte("compressible "), 1000), random, []byte("x")}
+		var stream []byte
+		for _, message := range messages {
+			stream = append(stream, compressor.Compress(message)...)
+		}
+		// 逐字节输入，帧不完整时留待下次
+		var received []byte
+		for i := range stream {
+			data, err := decompressor.Decompress(stream[i : i+1])
+			if err != nil {
+				t.Fatalf("%s decompress error: %v", method, err)
+			}
+			received = append(received, data...)
+		}
+		if !bytes.Equal(received, bytes.Join(messages, nil)) {
+			t.Fatalf("%s round trip not match", method)
+		}
+	}
+}
+
+func TestCompressorFrames(t *testing.T) {
+	compressor, _ := NewCompressor(CompressZstd)
+	defer compressor.Close()
+	// 可压缩的数据压缩后发送
+	frame := compressor.Compress(bytes.Repeat([]byte("a"), 10000))
+	if frame[0] != compressFrameCompressed || len(frame) >= 10000 {
+		t.Fatalf("frame type %d, size %d", frame[0], len(frame))
+	}
+	// 压缩后不变小的数据原样发送
+	random, _ := RandBytes(1024)
+	frame = compressor.Compress(random)
+	if frame[0] != compressFrameRaw || !bytes.Equal(frame[compressHeaderSize:], random) {
+		t.Fatal("incompressible data should be sent raw")
+	}
+	if int(binary.BigEndian.Uint32(frame[1:])) != len(random) {
+		t.Fatal("bad frame length")
+	}
+}
+
+func TestCompressorBadFrames(t *testing.T) {
+	decompressor, _ := NewCompressor(CompressSnappy)
+	header := make([]byte, compressHeaderSize)
+	binary.BigEndian.PutUint32(header[1:], compressMaxFrame+1)
+	if _, err := decompressor.Decompress(header); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("oversize frame error %v, expected too large", err)
+	}
+
+	decompressor, _ = NewCompressor(CompressSnappy)
+	if _, err := decompressor.Decompress([]byte{9, 0, 0, 0, 1, 'x'}); err == nil {
+		t.Fatal("unknow frame type should fail")
+	}
+
+	decompressor, _ = NewCompressor(CompressZstd)
+	if _, err := decompressor.Decompress([]byte{compressFrameCompressed, 0, 0, 0, 3, 1, 2, 3}); err == nil {
+		t.Fatal("corrupted compressed frame should fail")
+	}
+}
+
+func TestParseCompressions(t *testing.T) {
+	methods, err := ParseCompressions("zstd, snappy")
+	if err != nil || strings.Join(methods, ",") != "zstd,snappy" {
+		t.Fatalf("unexpected methods %v, %v", methods, err)
+	}
+	if _, err := ParseCompressions("gzip"); err == nil {
+		t.Fatal("unknow compression should fail")
+	}
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 控制消息每帧的最大明文长度
+const controlFrameSize = 16 * 1024
+
+// ErrControlMessage 控制消息未通过认证（被篡改或密钥不一致）
+var ErrControlMessage = errors.New("bad control message")
+
+// ControlConn 握手后的控制连接（绑定、访问、单端口转发的请求和响应，及加密转发时协商加密套件）。
+// 握手版本2时每次Write为一帧：长度(2) | ChaCha20-Poly1305密文，密钥由握手密钥及本次握手的nonce派生，
+// 每个方向各一个密钥，nonce为帧序号，不能重放或调换；版本1（兼容旧版本）或握手密钥为空时为明文
+// （握手记录是明文的，空密钥派生的密钥任何人都能算出）。
+// 每次只读取一帧，控制消息之后转发的数据直接使用原连接（Conn）
+type ControlConn struct {
+	net.Conn
+	// 握手记录（版本2），转发时派生加密套件的密钥
+	transcript []byte
+	initiator  bool
+	sealer     cipher.AEAD
+	opener     cipher.AEAD
+	writeSeq   uint64
+	readSeq    uint64
+	readBuf    []byte
+	writeLock  sync.Mutex
+	readLock   sync.Mutex
+}
+
+// 由握手记录创建控制连接，记录为空（版本1）或握手密钥为空时为明文
+func (it *Handshaker) newControlConn(conn net.Conn, transcript []byte, initiator bool) (*ControlConn, error) {
+	if transcript == nil || it.UserKey == "" {
+		return &ControlConn{Conn: conn, initiator: initiator}, nil
+	}
+	derive := func(label string) (cipher.AEAD, error) {
+		key := make([]byte, chacha20poly1305.KeySize)
+		io.ReadFull(hkdf.New(sha256.New, []byte(it.UserKey), transcript, []byte("tcprp control "+label)), key)
+		return chacha20poly1305.New(key)
+	}
+	initiatorAead, err := derive("initiator")
+	if err != nil {
+		return nil, err
+	}
+	responderAead, err := derive("responder")
+	if err != nil {
+		return nil, err
+	}
+	controlConn := &ControlConn{Conn: conn, transcript: transcript, initiator: initiator, sealer: responderAead, opener: initiatorAead}
+	if initiator {
+		controlConn.sealer, controlConn.opener = initiatorAead, responderAead
+	}
+	return controlConn, nil
+}
+
+// Encrypted 控制消息是否加密（握手版本2）
+func (it *ControlConn) Encrypted() bool {
+	return it.sealer != nil
+}
+
+func controlNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (it *ControlConn) Write(data []byte) (int, error) {
+	if it.sealer == nil {
+		return it.Conn.Write(data)
+	}
+	it.writeLock.Lock()
+	defer it.writeLock.Unlock()
+	written := 0
+	for written < len(data) {
+		size := len(data) - written
+		if size > controlFrameSize {
+			size = controlFrameSize
+		}
+		frame := make([]byte, 2, 2+size+it.sealer.Overhead())
+		frame = it.sealer.Seal(frame, controlNonce(it.writeSeq), data[written:written+size], nil)
+		binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+		it.writeSeq++
+		if _, err := it.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += size
+	}
+	return written, nil
+}
+
+func (it *ControlConn) Read(data []byte) (int, error) {
+	if it.opener == nil {
+		return it.Conn.Read(data)
+	}
+	it.readLock.Lock()
+	defer it.readLock.Unlock()
+	if len(it.readBuf) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(it.Conn, header); err != nil {
+			return 0, err
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(it.Conn, frame); err != nil {
+			return 0, err
+		}
+		plain, err := it.opener.Open(frame[:0], controlNonce(it.readSeq), frame, nil)
+		if err != nil {
+			return 0, ErrControlMessage
+		}
+		it.readSeq++
+		it.readBuf = plain
+	}
+	n := copy(data, it.readBuf)
+	it.readBuf = it.readBuf[n:]
+	return n, nil
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// 内存中的连接，写入的数据可再读出
+type bufferConn struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+func (it *bufferConn) Read(b []byte) (int, error) {
+	return it.buffer.Read(b)
+}
+
+func (it *bufferConn) Write(b []byte) (int, error) {
+	return it.buffer.Write(b)
+}
+
+// 同一次握手的发起方及响应方的控制连接（共用一个内存连接）
+func controlConnPair(t *testing.T, key string) (*ControlConn, *ControlConn, *bufferConn) {
+	conn := &bufferConn{}
+	transcript, err := RandBytes(52)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshaker := MakeHandshaker(key, false)
+	initiator, err := handshaker.newControlConn(conn, transcript, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := handshaker.newControlConn(conn, transcript, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiator, responder, conn
+}
+
+func TestControlConnRoundTrip(t *testing.T) {
+	initiator, responder, conn := controlConnPair(t, "key")
+	if !initiator.Encrypted() || !responder.Encrypted() {
+		t.Fatal("the version 2 control connection should be encrypted")
+	}
+	request := &VisitRequest{Reqeust: Reqeust{Action: "visit"}, SecretName: "name"}
+	if err := WriteObject2Json(initiator, request); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(conn.buffer.Bytes(), []byte("visit")) {
+		t.Fatal("the control message is not encrypted")
+	}
+	received := &VisitRequest{}
+	if err := ReadJson2Object(responder, received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Action != "visit" || received.SecretName != "name" {
+		t.Fatalf("unexpected request %+v", received)
+	}
+
+	// 反方向
+	if err := WriteObject2Json(responder, &Response{Message: "success"}); err != nil {
+		t.Fatal(err)
+	}
+	response := &Response{}
+	if err := ReadJson2Object(initiator, response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Message != "success" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+}
+
+func TestControlConnLargeMessage(t *testing.T) {
+	initiator, responder, conn := controlConnPair(t, "key")
+	message := bytes.Repeat([]byte("0123456789"), controlFrameSize/4)
+	if _, err := initiator.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	// 每帧不超过最大长度
+	data := conn.buffer.Bytes()
+	frames := 0
+	for offset := 0; offset < len(data); frames++ {
+		size := int(binary.BigEndian.Uint16(data[offset:]))
+		if size > controlFrameSize+chacha20poly1305.Overhead {
+			t.Fatalf("frame size %d too large", size)
+		}
+		offset += 2 + size
+	}
+	if frames < 3 {
+		t.Fatalf("%d frames, expected at least 3", frames)
+	}
+	received := make([]byte, len(message))
+	for n := 0; n < len(received); {
+		size, err := responder.Read(received[n:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += size
+	}
+	if !bytes.Equal(received, message) {
+		t.Fatal("large message not match")
+	}
+}
+
+func TestControlConnTampered(t *testing.T) {
+	initiator, responder, conn := controlConnPair(t, "key")
+	if _, err := initiator.Write([]byte(`{"action":"bind"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.buffer.Bytes()[5] ^= 0x01
+	if _, err := responder.Read(make([]byte, 64)); !errors.Is(err, ErrControlMessage) {
+		t.Fatalf("tampered frame error %v, expected ErrControlMessage", err)
+	}
+}
+
+func TestControlConnReordered(t *testing.T) {
+	initiator, responder, conn := controlConnPair(t, "key")
+	initiator.Write([]byte("first"))
+	first := append([]byte{}, conn.buffer.Bytes()...)
+	conn.buffer.Reset()
+	initiator.Write([]byte("second"))
+	second := append([]byte{}, conn.buffer.Bytes()...)
+	conn.buffer.Reset()
+	conn.buffer.Write(second)
+	conn.buffer.Write(first)
+	if _, err := responder.Read(make([]byte, 64)); !errors.Is(err, ErrControlMessage) {
+		t.Fatalf("reordered frame error %v, expected ErrControlMessage", err)
+	}
+}
+
+func TestControlConnReflected(t *testing.T) {
+	// 发起方不能读出自己发送的帧（每个方向各一个密钥）
+	initiator, _, _ := controlConnPair(t, "key")
+	initiator.Write([]byte("message"))
+	if _, err := initiator.Read(make([]byte, 64)); !errors.Is(err, ErrControlMessage) {
+		t.Fatalf("reflected frame error %v, expected ErrControlMessage", err)
+	}
+}
+
+func TestControlConnWrongKey(t *testing.T) {
+	conn := &bufferConn{}
+	transcript, _ := RandBytes(52)
+	initiator, _ := MakeHandshaker("key", false).newControlConn(conn, transcript, true)
+	responder, _ := MakeHandshaker("other", false).newControlConn(conn, transcript, false)
+	initiator.Write([]byte("message"))
+	if _, err := responder.Read(make([]byte, 64)); !errors.Is(err, ErrControlMessage) {
+		t.Fatalf("wrong key error %v, expected ErrControlMessage", err)
+	}
+}
+
+func TestControlConnLegacy(t *testing.T) {
+	conn := &bufferConn{}
+	controlConn, err := MakeHandshaker("key", true).newControlConn(conn, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if controlConn.Encrypted() {
+		t.Fatal("the version 1 control connection should not be encrypted")
+	}
+	controlConn.Write([]byte("plain"))
+	if !strings.Contains(conn.buffer.String(), "plain") {
+		t.Fatal("the version 1 control message should be plain")
+	}
+}
+
+func TestControlConnEmptyKey(t *testing.T) {
+	// 空密钥派生的密钥可由明文的握手记录算出，不作为加密的控制连接
+	initiator, responder, _ := controlConnPair(t, "")
+	if initiator.Encrypted() || responder.Encrypted() {
+		t.Fatal("the control connection with an empty key should not be encrypted")
+	}
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 加密密钥的前缀：原始的256位密钥（hex或base64），或从密钥文件读取，其他为口令
+const (
+	EncryptKeyHexPrefix    = "hex:"
+	EncryptKeyBase64Prefix = "base64:"
+	EncryptKeyFilePrefix   = "file:"
+)
+
+// DefaultEncryptSalt 未设置盐时口令派生使用的盐，每个部署应设置自己的盐
+const DefaultEncryptSalt = "tcp-reverse-proxy"
+
+// 口令派生（Argon2id）的参数：3次迭代、64MB内存、4线程
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+// EncryptKey LAN与CLIENT之间转发的主密钥，口令经Argon2id派生，原始密钥直接使用，
+// 再按用途经HKDF派生加密、握手及证明的密钥。只在启动时解析一次（Argon2id耗时）
+type EncryptKey struct {
+	master []byte
+	salt   []byte
+	// 兼容旧版本时的口令（按字节重复拉伸为密钥）
+	legacy string
+}
+
+// ParseEncryptKey 解析加密密钥，"hex:"、"base64:" 开头为原始的256位密钥，"file:" 开头为密钥文件，
+// 否则为口令，salt为空时使用默认的盐，legacy为true时口令按旧版本的方式使用
+func ParseEncryptKey(key string, salt string, legacy bool) (*EncryptKey, error) {
+	if salt == "" {
+		salt = DefaultEncryptSalt
+	}
+	it := &EncryptKey{salt: []byte(salt)}
+	var err error
+	switch {
+	case key == "":
+		return nil, fmt.Errorf("empty encrypt key")
+	case strings.HasPrefix(key, EncryptKeyHexPrefix), strings.HasPrefix(key, EncryptKeyBase64Prefix):
+		it.master, err = decodeRawKey(key)
+	case strings.HasPrefix(key, EncryptKeyFilePrefix):
+		it.master, err = readKeyFile(strings.TrimPrefix(key, EncryptKeyFilePrefix))
+	case legacy:
+		it.legacy = key
+	default:
+		it.master = argon2.IDKey([]byte(key), it.salt, argon2Time, argon2Memory, argon2Threads, uint32(KeySize256))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// GenerateEncryptKey 生成随机的256位密钥
+func GenerateEncryptKey() ([]byte, error) {
+	key := make([]byte, KeySize256)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// 解析带前缀的原始密钥
+func decodeRawKey(key string) ([]byte, error) {
+	var data []byte
+	var err error
+	if value, found := strings.CutPrefix(key, EncryptKeyHexPrefix); found {
+		data, err = hex.DecodeString(value)
+	} else {
+		data, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(key, EncryptKeyBase64Prefix))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad encrypt key: %s", err.Error())
+	}
+	if len(data) != KeySize256 {
+		return nil, fmt.Errorf("bad encrypt key length %d, must be %d bytes", len(data), KeySize256)
+	}
+	return data, nil
+}
+
+// 读取密钥文件：32字节的二进制，或hex、base64的文本（可带前缀）
+func readKeyFile(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == KeySize256 {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, EncryptKeyHexPrefix) || strings.HasPrefix(text, EncryptKeyBase64Prefix) {
+		return decodeRawKey(text)
+	}
+	if key, err := decodeRawKey(EncryptKeyHexPrefix + text); err == nil {
+		return key, nil
+	}
+	if key, err := decodeRawKey(EncryptKeyBase64Prefix + text); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("bad key file %s: not a 256-bit key", file)
+}
+
+// 按用途派生密钥，salt为空时使用部署的盐
+func (it *EncryptKey) derive(info string, size int, salt []byte) []byte {
+	if salt == nil {
+		salt = it.salt
+	}
+	secret := it.master
+	if secret == nil {
+		secret = []byte(it.legacy)
+	}
+	data := make([]byte, size)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), data)
+	return data
+}
+
+// Legacy 是否为按旧版本方式使用的口令
+func (it *EncryptKey) Legacy() bool {
+	return it.legacy != ""
+}
+
+// NewCryptor 创建转发的加解密器，suite为协商的加密套件，密钥由主密钥及本次转发握手的记录派生，
+// 每个连接及方向各不相同；握手为版本1（兼容旧版本，未协商）时只有旧版本的口令可用（ChaCha20流加密），
+// 原始密钥及Argon2id派生的密钥没有每个连接的密钥，拒绝使用；套件为none时返回空
+func (it *EncryptKey) NewCryptor(suite string, controlConn *ControlConn) (Cryptor, error) {
+	if !controlConn.Encrypted() {
+		if it.legacy != "" {
+			return NewXChaCha20Crypto(it.legacy)
+		}
+		return nil, fmt.Errorf("the version 1 handshake can only use a legacy passphrase, not a raw or derived key")
+	}
+	cipherSuite := GetCipherSuite(suite)
+	if cipherSuite == nil {
+		return nil, fmt.Errorf("unknow cipher suite %s", suite)
+	}
+	if cipherSuite.NewAead == nil {
+		return nil, nil
+	}
+	initiatorKey := it.derive("tcprp relay "+suite+" initiator", KeySize256, controlConn.transcript)
+	responderKey := it.derive("tcprp relay "+suite+" responder", KeySize256, controlConn.transcript)
+	if controlConn.initiator {
+		return newAeadCryptor(cipherSuite, initiatorKey, responderKey)
+	}
+	return newAeadCryptor(cipherSuite, responderKey, initiatorKey)
+}
+
+// HandshakeKey LAN与CLIENT转发握手的密钥
+func (it *EncryptKey) HandshakeKey() string {
+	if it.legacy != "" {
+		return it.legacy
+	}
+	return hex.EncodeToString(it.derive("tcprp relay handshake", KeySize256, nil))
+}
+
+// ProofKey CLIENT的证明密钥，WAN以此在开放端口验证CLIENT，不能用于解密流量
+func (it *EncryptKey) ProofKey() string {
+	if it.legacy != "" {
+		m := hmac.New(sha256.New, []byte(it.legacy))
+		m.Write([]byte("tcprp relay proof"))
+		return hex.EncodeToString(m.Sum(nil))
+	}
+	return hex.EncodeToString(it.derive("tcprp relay proof", KeySize256, nil))
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptKeyNewCryptor(t *testing.T) {
+	key, err := ParseEncryptKey("hex:"+strings.Repeat("ab", KeySize256), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript, _ := RandBytes(52)
+	handshaker := MakeHandshaker(key.HandshakeKey(), false)
+	initiatorConn, _ := handshaker.newControlConn(&bufferConn{}, transcript, true)
+	responderConn, _ := handshaker.newControlConn(&bufferConn{}, transcript, false)
+	for _, name := range aeadSuites {
+		initiator, err := key.NewCryptor(name, initiatorConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responder, err := key.NewCryptor(name, responderConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := responder.Decrypt(initiator.Encrypt([]byte("hello")))
+		if err != nil || string(plain) != "hello" {
+			t.Fatalf("%s: %q, %v", name, plain, err)
+		}
+		plain, err = initiator.Decrypt(responder.Encrypt([]byte("world")))
+		if err != nil || string(plain) != "world" {
+			t.Fatalf("%s: %q, %v", name, plain, err)
+		}
+	}
+
+	// 每次握手的密钥不同
+	otherTranscript, _ := RandBytes(52)
+	otherConn, _ := handshaker.newControlConn(&bufferConn{}, otherTranscript, false)
+	initiator, _ := key.NewCryptor(CipherChaCha20Poly1305, initiatorConn)
+	other, _ := key.NewCryptor(CipherChaCha20Poly1305, otherConn)
+	if _, err := other.Decrypt(initiator.Encrypt([]byte("hello"))); err == nil {
+		t.Fatal("cryptors of different handshakes should not match")
+	}
+
+	// none不加密
+	cryptor, err := key.NewCryptor(CipherNone, initiatorConn)
+	if err != nil || cryptor != nil {
+		t.Fatalf("none cipher suite: %v, %v", cryptor, err)
+	}
+
+	// 版本1的握手不能使用原始密钥
+	legacyConn, _ := MakeHandshaker(key.HandshakeKey(), true).newControlConn(&bufferConn{}, nil, true)
+	if _, err := key.NewCryptor(CipherChaCha20Poly1305, legacyConn); err == nil {
+		t.Fatal("a raw key should be refused on the version 1 handshake")
+	}
+}
+
+func TestParseEncryptKey(t *testing.T) {
+	hexKey, err := ParseEncryptKey(EncryptKeyHexPrefix+strings.Repeat("ab", KeySize256), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base64Key, err := ParseEncryptKey(EncryptKeyBase64Prefix+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xab}, KeySize256)), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hexKey.HandshakeKey() != base64Key.HandshakeKey() {
+		t.Fatal("the same raw key in hex and base64 should match")
+	}
+	for _, key := range []string{"", EncryptKeyHexPrefix + "abcd", EncryptKeyBase64Prefix + "!", EncryptKeyFilePrefix + filepath.Join(t.TempDir(), "none")} {
+		if _, err := ParseEncryptKey(key, "", false); err == nil {
+			t.Fatalf("bad key %q should fail", key)
+		}
+	}
+
+	// 密钥文件
+	file := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(file, []byte(strings.Repeat("ab", KeySize256)+"\n"), 0600)
+	fileKey, err := ParseEncryptKey(EncryptKeyFilePrefix+file, "", false)
+	if err != nil || fileKey.HandshakeKey() != hexKey.HandshakeKey() {
+		t.Fatalf("key file: %v", err)
+	}
+}
+
+func TestEncryptKeyPassphrase(t *testing.T) {
+	key, _ := ParseEncryptKey("passphrase", "salt", false)
+	same, _ := ParseEncryptKey("passphrase", "salt", false)
+	otherSalt, _ := ParseEncryptKey("passphrase", "other", false)
+	if key.HandshakeKey() != same.HandshakeKey() || key.ProofKey() != same.ProofKey() {
+		t.Fatal("the same passphrase and salt should derive the same keys")
+	}
+	if key.HandshakeKey() == otherSalt.HandshakeKey() {
+		t.Fatal("a different salt should derive different keys")
+	}
+	// 各用途的密钥不同，证明密钥不能推出握手密钥
+	if key.HandshakeKey() == key.ProofKey() {
+		t.Fatal("the handshake and proof keys should differ")
+	}
+	if key.Legacy() {
+		t.Fatal("a derived key is not legacy")
+	}
+	legacy, _ := ParseEncryptKey("passphrase", "", true)
+	if !legacy.Legacy() || legacy.HandshakeKey() != "passphrase" {
+		t.Fatal("a legacy passphrase is used as is")
+	}
+}
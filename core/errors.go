@@ -0,0 +1,46 @@
+package core
+
+import (
+	"errors"
+)
+
+// ErrClosed 服务已关闭（调用了Close）
+var ErrClosed = errors.New("closed")
+
+// ErrHandshake 握手失败（对方不持有密钥或重放），区别于连接错误
+var ErrHandshake = errors.New("handshake failed")
+
+// ConfigError 配置错误
+type ConfigError struct {
+	// 配置项名称
+	Field   string
+	Message string
+}
+
+func (it *ConfigError) Error() string {
+	return it.Message
+}
+
+// ListenError 监听端口失败
+type ListenError struct {
+	Address string
+	Err     error
+}
+
+func (it *ListenError) Error() string {
+	return "listen " + it.Address + " error: " + it.Err.Error()
+}
+
+func (it *ListenError) Unwrap() error {
+	return it.Err
+}
+
+// BindError 服务端拒绝绑定开放端口
+type BindError struct {
+	OpenPort string
+	Message  string
+}
+
+func (it *BindError) Error() string {
+	return "bind open port " + it.OpenPort + " error: " + it.Message
+}
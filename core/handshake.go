@@ -1,39 +1,121 @@
 package core
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
-
-	"golang.org/x/exp/slices"
 )
 
+// 握手（版本2）：
+//
+//	发起方 -> 响应方  challenge: magic(4) | 用途(1) | nonce(59)
+//	响应方 -> 发起方  response:  时间戳(8) | nonce(24) | HMAC("response", challenge | 时间戳 | nonce)
+//	发起方 -> 响应方  confirm:   HMAC("confirm", challenge | 时间戳 | nonce)
+//
+// 发起方（如绑定端口的WAN）只发送随机的挑战，由连接的一方先以密钥应答，不知道密钥的连接得不到
+// 可离线猜测密钥的数据。双方的nonce防止重放response及confirm，时间戳及nonce缓存再防止重放response，
+// 标签区分角色避免反射。响应方有多个握手器（如CLIENT的证明及转发握手）时按挑战中的用途选择。
+// 版本1（Legacy）只有hello及response，没有时间戳，可被重放，仅用于兼容旧版本
 type Handshaker struct {
 	UserKey string
+	// 发起方使用版本1，响应方同时接受版本1及版本2
+	Legacy bool
+	// CLIENT的证明握手（WAN在加密的开放端口验证CLIENT），区别于LAN与CLIENT的转发握手
+	Proof bool
 }
 
 const HandshakeDataLength = 64
 
-func MakeHandshaker(key string) *Handshaker {
+// HandshakeVersion 当前的握手版本，绑定时告知对方
+const HandshakeVersion = 2
+
+// HandshakeMaxSkew 握手时间戳允许的时间偏差
+var HandshakeMaxSkew = 2 * time.Minute
+
+var handshakeMagic = []byte{'T', 'R', 'P', HandshakeVersion}
+
+// 已使用的response nonce，过期（超出时间偏差）后清理
+var handshakeNonces = &nonceCache{nonces: map[string]time.Time{}, lock: &sync.Mutex{}}
+
+func MakeHandshaker(key string, legacy bool) *Handshaker {
+	return &Handshaker{
+		UserKey: key,
+		Legacy:  legacy,
+	}
+}
+
+// MakeProofHandshaker CLIENT证明的握手器（版本2）
+func MakeProofHandshaker(key string) *Handshaker {
 	return &Handshaker{
 		UserKey: key,
+		Proof:   true,
+	}
+}
+
+func (it *Handshaker) mac(label string, data ...[]byte) []byte {
+	m := hmac.New(sha256.New, []byte(it.UserKey))
+	m.Write([]byte(label))
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+// 挑战中的用途
+func (it *Handshaker) purpose() byte {
+	if it.Proof {
+		return 1
+	}
+	return 0
+}
+
+func (it *Handshaker) makeChallenge() ([]byte, error) {
+	nonce, err := RandBytes(HandshakeDataLength - len(handshakeMagic) - 1)
+	if err != nil {
+		return nil, err
 	}
+	challenge := make([]byte, 0, HandshakeDataLength)
+	challenge = append(challenge, handshakeMagic...)
+	challenge = append(challenge, it.purpose())
+	return append(challenge, nonce...), nil
 }
 
-func (it *Handshaker) makeHandshake(data []byte) [HandshakeDataLength]byte {
-	iv := RandBytes(32)
+// 检查已通过认证的版本2应答的时间戳及nonce
+func checkResponse(response []byte) error {
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(response[:8])), 0)
+	if skew := time.Since(timestamp); skew > HandshakeMaxSkew || skew < -HandshakeMaxSkew {
+		return fmt.Errorf("%w: expired, check the clock", ErrHandshake)
+	}
+	if !handshakeNonces.add(string(response[8:32]), timestamp) {
+		return fmt.Errorf("%w: replayed", ErrHandshake)
+	}
+	return nil
+}
+
+// 版本1
+func (it *Handshaker) makeHandshake(data []byte) ([HandshakeDataLength]byte, error) {
+	iv, err := RandBytes(32)
+	if err != nil {
+		return [HandshakeDataLength]byte{}, err
+	}
 	tmp := []byte{}
 	tmp = append(tmp, iv...)
 	tmp = append(tmp, []byte(it.UserKey)...)
 	tmp = append(tmp, data...)
 	hash := getSha256(tmp)
 	bytes := [HandshakeDataLength]byte(append(iv, hash...))
-	return bytes
+	return bytes, nil
 }
 
+// 版本1
 func (it *Handshaker) checkHandshake(handshakeData [HandshakeDataLength]byte, data []byte) bool {
 	iv := handshakeData[:32]
 	hash := handshakeData[32:]
@@ -42,11 +124,39 @@ func (it *Handshaker) checkHandshake(handshakeData [HandshakeDataLength]byte, da
 	tmp = append(tmp, []byte(it.UserKey)...)
 	tmp = append(tmp, data...)
 	hash2 := getSha256(tmp)
-	return slices.Equal(hash, hash2)
+	return subtle.ConstantTimeCompare(hash, hash2) == 1
 }
 
-// 处理连接
+// 处理连接（响应方）
 func (it *Handshaker) RwHandshake(conn net.Conn, ioTimeout int) error {
+	_, _, err := rwHandshakeAny(conn, ioTimeout, it)
+	return err
+}
+
+// RwControlHandshake 处理绑定端口或加密转发的连接（响应方），返回握手后的控制连接
+func (it *Handshaker) RwControlHandshake(conn net.Conn, ioTimeout int) (*ControlConn, error) {
+	_, controlConn, err := RwControlHandshakeAny(conn, ioTimeout, it)
+	return controlConn, err
+}
+
+// RwControlHandshakeAny 同RwHandshakeAny，并返回握手后的控制连接
+func RwControlHandshakeAny(conn net.Conn, ioTimeout int, handshakers ...*Handshaker) (*Handshaker, *ControlConn, error) {
+	handshaker, transcript, err := rwHandshakeAny(conn, ioTimeout, handshakers...)
+	if err != nil {
+		return nil, nil, err
+	}
+	controlConn, err := handshaker.newControlConn(conn, transcript, false)
+	return handshaker, controlConn, err
+}
+
+// RwHandshakeAny 处理连接（响应方），按发起方的握手数据匹配其中一个握手器（密钥），返回匹配的握手器
+func RwHandshakeAny(conn net.Conn, ioTimeout int, handshakers ...*Handshaker) (*Handshaker, error) {
+	handshaker, _, err := rwHandshakeAny(conn, ioTimeout, handshakers...)
+	return handshaker, err
+}
+
+// 返回匹配的握手器及版本2的握手记录（challenge | 响应方的时间戳及nonce），版本1时记录为空
+func rwHandshakeAny(conn net.Conn, ioTimeout int, handshakers ...*Handshaker) (*Handshaker, []byte, error) {
 	// 处理远程的握手
 	var handshakeData = make([]byte, HandshakeDataLength)
 	if ioTimeout > 0 {
@@ -55,31 +165,149 @@ func (it *Handshaker) RwHandshake(conn net.Conn, ioTimeout int) error {
 	}
 	_, err := io.ReadFull(conn, handshakeData)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if ioTimeout > 0 {
+		defer conn.SetWriteDeadline(time.Time{})
+		conn.SetWriteDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
+	}
+
+	for _, it := range handshakers {
+		if it.Legacy && it.checkHandshake([HandshakeDataLength]byte(handshakeData), nil) {
+			// 版本1的握手响应
+			newHandshakeData, err := it.makeHandshake(handshakeData)
+			if err != nil {
+				return nil, nil, err
+			}
+			_, err = conn.Write(newHandshakeData[:])
+			return it, nil, err
+		}
+	}
+	// 版本2，按用途选择握手器
+	if bytes.Equal(handshakeData[:len(handshakeMagic)], handshakeMagic) {
+		for _, it := range handshakers {
+			if it.purpose() == handshakeData[len(handshakeMagic)] {
+				transcript, err := it.respondChallenge(conn, handshakeData, ioTimeout)
+				return it, transcript, err
+			}
+		}
 	}
-	// 错误的握手数据
-	if !it.checkHandshake([HandshakeDataLength]byte(handshakeData), nil) {
-		return fmt.Errorf("handshake not match")
+	return nil, nil, fmt.Errorf("%w: not match", ErrHandshake)
+}
+
+// 以密钥应答版本2的挑战，验证发起方的confirm，返回握手记录
+func (it *Handshaker) respondChallenge(conn net.Conn, challenge []byte, ioTimeout int) ([]byte, error) {
+	nonce, err := RandBytes(24)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, 0, HandshakeDataLength)
+	response = binary.BigEndian.AppendUint64(response, uint64(time.Now().Unix()))
+	response = append(response, nonce...)
+	if _, err := conn.Write(append(response, it.mac("response", challenge, response)...)); err != nil {
+		return nil, err
+	}
+	confirm := make([]byte, sha256.Size)
+	if ioTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
+	}
+	if _, err := io.ReadFull(conn, confirm); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(confirm, it.mac("confirm", challenge, response[:32])) {
+		return nil, fmt.Errorf("%w: not match", ErrHandshake)
+	}
+	return append(append([]byte{}, challenge...), response[:32]...), nil
+}
+
+// 发起握手（发起方）
+func (handshaker *Handshaker) WrHandshake(conn net.Conn, ioTimeout int) error {
+	_, err := handshaker.wrHandshake(conn, ioTimeout)
+	return err
+}
+
+// WrControlHandshake 发起绑定端口或加密转发的握手（发起方），返回握手后的控制连接
+func (handshaker *Handshaker) WrControlHandshake(conn net.Conn, ioTimeout int) (*ControlConn, error) {
+	transcript, err := handshaker.wrHandshake(conn, ioTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return handshaker.newControlConn(conn, transcript, true)
+}
+
+// WrControlHandshakeAny 发起绑定端口的握手（发起方），按应答匹配其中一个握手器（如访问者的访问密钥），
+// 返回匹配的握手器及握手后的控制连接
+func WrControlHandshakeAny(conn net.Conn, ioTimeout int, handshakers ...*Handshaker) (*Handshaker, *ControlConn, error) {
+	handshaker, transcript, err := wrHandshakeAny(conn, ioTimeout, handshakers...)
+	if err != nil {
+		return nil, nil, err
 	}
+	controlConn, err := handshaker.newControlConn(conn, transcript, true)
+	return handshaker, controlConn, err
+}
+
+// 返回版本2的握手记录，版本1时为空
+func (handshaker *Handshaker) wrHandshake(conn net.Conn, ioTimeout int) ([]byte, error) {
+	_, transcript, err := wrHandshakeAny(conn, ioTimeout, handshaker)
+	return transcript, err
+}
 
-	// 握手响应
-	newHandshakeData := it.makeHandshake(handshakeData)
+// 返回匹配应答的握手器及版本2的握手记录，第一个握手器决定用途，为版本1时只使用它
+func wrHandshakeAny(conn net.Conn, ioTimeout int, handshakers ...*Handshaker) (*Handshaker, []byte, error) {
+	handshaker := handshakers[0]
+	if handshaker.Legacy {
+		return handshaker, nil, handshaker.wrHandshakeV1(conn, ioTimeout)
+	}
+
+	// 发送挑战，不含任何由密钥计算的数据
+	challenge, err := handshaker.makeChallenge()
+	if err != nil {
+		return nil, nil, err
+	}
 	if ioTimeout > 0 {
 		defer conn.SetWriteDeadline(time.Time{})
 		conn.SetWriteDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
 	}
-	_, err = conn.Write(newHandshakeData[:])
-	return err
+	if _, err := conn.Write(challenge); err != nil {
+		return nil, nil, err
+	}
+	// 读应答
+	response := make([]byte, HandshakeDataLength)
+	if ioTimeout > 0 {
+		defer conn.SetReadDeadline(time.Time{})
+		conn.SetReadDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
+	}
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, nil, err
+	}
+	for _, it := range handshakers {
+		if it.Legacy || it.Proof != handshaker.Proof || !hmac.Equal(response[32:], it.mac("response", challenge, response[:32])) {
+			continue
+		}
+		if err := checkResponse(response); err != nil {
+			return nil, nil, err
+		}
+		// 确认，对方由此验证发起方
+		if _, err := conn.Write(it.mac("confirm", challenge, response[:32])); err != nil {
+			return nil, nil, err
+		}
+		return it, append(challenge, response[:32]...), nil
+	}
+	// 错误的应答
+	return nil, nil, fmt.Errorf("%w: not match", ErrHandshake)
 }
 
-func (handshaker *Handshaker) WrHandshake(conn net.Conn, ioTimeout int) error {
+func (handshaker *Handshaker) wrHandshakeV1(conn net.Conn, ioTimeout int) error {
 	// 发送握手指令
-	handshakeData := handshaker.makeHandshake([]byte{})
+	handshakeData, err := handshaker.makeHandshake([]byte{})
+	if err != nil {
+		return err
+	}
 	if ioTimeout > 0 {
 		defer conn.SetWriteDeadline(time.Time{})
 		conn.SetWriteDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
 	}
-	_, err := conn.Write(handshakeData[:])
+	_, err = conn.Write(handshakeData[:])
 	if err != nil {
 		return err
 	}
@@ -95,11 +323,39 @@ func (handshaker *Handshaker) WrHandshake(conn net.Conn, ioTimeout int) error {
 	}
 	// 错误的响应
 	if !handshaker.checkHandshake([HandshakeDataLength]byte(newHandshakeData), handshakeData[:]) {
-		return fmt.Errorf("handshaker not match")
+		return fmt.Errorf("%w: not match", ErrHandshake)
 	}
 	return nil
 }
 
+// 握手nonce的重放缓存
+type nonceCache struct {
+	nonces map[string]time.Time
+	lock   sync.Locker
+	// 上次清理的时间，每秒最多清理一次
+	purged time.Time
+}
+
+// 加入nonce，已存在时返回false
+func (it *nonceCache) add(nonce string, timestamp time.Time) bool {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	now := time.Now()
+	if now.Sub(it.purged) > time.Second {
+		it.purged = now
+		for key, t := range it.nonces {
+			if now.Sub(t) > HandshakeMaxSkew {
+				delete(it.nonces, key)
+			}
+		}
+	}
+	if _, ok := it.nonces[nonce]; ok {
+		return false
+	}
+	it.nonces[nonce] = timestamp
+	return true
+}
+
 func getSha256(data []byte) []byte {
 	m := sha256.New()
 	defer m.Reset()
@@ -107,11 +363,11 @@ func getSha256(data []byte) []byte {
 	return m.Sum(nil)
 }
 
-func RandBytes(len int) (randbs []byte) {
+// RandBytes 安全的随机字节，随机数不可用时返回错误（不能以全零的字节继续）
+func RandBytes(len int) ([]byte, error) {
 	randBytes := make([]byte, len)
-	_, err := io.ReadFull(rand.Reader, randBytes)
-	if err != nil {
-		fmt.Println(err)
+	if _, err := io.ReadFull(rand.Reader, randBytes); err != nil {
+		return nil, fmt.Errorf("random bytes: %w", err)
 	}
-	return randBytes
+	return randBytes, nil
 }
@@ -0,0 +1,240 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 在内存连接上握手，返回响应方匹配的握手器、发起方及响应方的错误
+func runHandshake(initiator *Handshaker, responders ...*Handshaker) (*Handshaker, error, error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	initiatorErr := make(chan error, 1)
+	go func() {
+		err := initiator.WrHandshake(a, 5)
+		if err != nil {
+			a.Close()
+		}
+		initiatorErr <- err
+	}()
+	matched, err := RwHandshakeAny(b, 5, responders...)
+	if err != nil {
+		b.Close()
+	}
+	return matched, <-initiatorErr, err
+}
+
+// 以指定的时间戳应答挑战
+func respondAt(responder *Handshaker, challenge []byte, timestamp time.Time) []byte {
+	nonce, _ := RandBytes(24)
+	response := binary.BigEndian.AppendUint64(nil, uint64(timestamp.Unix()))
+	response = append(response, nonce...)
+	return append(response, responder.mac("response", challenge, response)...)
+}
+
+// 发起方发出挑战后以reply的结果应答，返回发起方的错误及之后发起方写出的数据（confirm）
+func initiate(initiator *Handshaker, reply func(challenge []byte) []byte) (error, []byte) {
+	a, b := net.Pipe()
+	defer b.Close()
+	initiatorErr := make(chan error, 1)
+	go func() {
+		err := initiator.WrHandshake(a, 5)
+		a.Close()
+		initiatorErr <- err
+	}()
+	challenge := make([]byte, HandshakeDataLength)
+	io.ReadFull(b, challenge)
+	b.Write(reply(challenge))
+	confirm, _ := io.ReadAll(b)
+	return <-initiatorErr, confirm
+}
+
+// 向响应方发送挑战，以confirmer的密钥确认，返回响应方的错误
+func confirmResponder(responder *Handshaker, confirmer *Handshaker) error {
+	a, b := net.Pipe()
+	defer a.Close()
+	responderErr := make(chan error, 1)
+	go func() {
+		_, _, err := rwHandshakeAny(b, 5, responder)
+		b.Close()
+		responderErr <- err
+	}()
+	challenge, _ := confirmer.makeChallenge()
+	a.Write(challenge)
+	response := make([]byte, HandshakeDataLength)
+	if _, err := io.ReadFull(a, response); err == nil {
+		a.Write(confirmer.mac("confirm", challenge, response[:32]))
+	}
+	return <-responderErr
+}
+
+func TestHandshakeAccept(t *testing.T) {
+	matched, initiatorErr, responderErr := runHandshake(MakeHandshaker("key", false), MakeHandshaker("key", false))
+	if initiatorErr != nil || responderErr != nil {
+		t.Fatalf("handshake error: %v, %v", initiatorErr, responderErr)
+	}
+	if matched == nil || matched.UserKey != "key" {
+		t.Fatalf("unexpected matched handshaker %v", matched)
+	}
+}
+
+func TestHandshakeWrongKey(t *testing.T) {
+	_, initiatorErr, responderErr := runHandshake(MakeHandshaker("key", false), MakeHandshaker("other", false))
+	if !errors.Is(initiatorErr, ErrHandshake) {
+		t.Fatalf("initiator error %v, expected ErrHandshake", initiatorErr)
+	}
+	if responderErr == nil {
+		t.Fatal("responder should fail")
+	}
+}
+
+func TestHandshakeChallengeFirst(t *testing.T) {
+	// 挑战只有magic、用途及随机数，不含由密钥计算的数据
+	for _, it := range []*Handshaker{MakeHandshaker("key", false), MakeProofHandshaker("key")} {
+		challenge, err := it.makeChallenge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(challenge) != HandshakeDataLength || !bytes.Equal(challenge[:4], handshakeMagic) || challenge[4] != it.purpose() {
+			t.Fatalf("unexpected challenge %x", challenge)
+		}
+	}
+	// 应答未通过认证时发起方不发送confirm
+	err, confirm := initiate(MakeHandshaker("key", false), func(challenge []byte) []byte {
+		return respondAt(MakeHandshaker("guess", false), challenge, time.Now())
+	})
+	if !errors.Is(err, ErrHandshake) || len(confirm) != 0 {
+		t.Fatalf("wrong response: %v, %x", err, confirm)
+	}
+}
+
+func TestHandshakeMatchAny(t *testing.T) {
+	// 发起方按应答匹配密钥，如WAN的绑定密钥及访问密钥
+	bind := MakeHandshaker("bind", false)
+	visit := MakeHandshaker("visit", false)
+	run := func(responderKey string) (*Handshaker, error, error) {
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		responderErr := make(chan error, 1)
+		go func() {
+			_, _, err := RwControlHandshakeAny(b, 5, MakeHandshaker(responderKey, false))
+			b.Close()
+			responderErr <- err
+		}()
+		matched, _, err := WrControlHandshakeAny(a, 5, bind, visit)
+		a.Close()
+		return matched, err, <-responderErr
+	}
+	matched, initiatorErr, responderErr := run("visit")
+	if initiatorErr != nil || responderErr != nil {
+		t.Fatalf("handshake error: %v, %v", initiatorErr, responderErr)
+	}
+	if matched != visit {
+		t.Fatal("the visit handshaker should match")
+	}
+	_, initiatorErr, responderErr = run("wrong")
+	if !errors.Is(initiatorErr, ErrHandshake) || responderErr == nil {
+		t.Fatalf("wrong key error: %v, %v", initiatorErr, responderErr)
+	}
+}
+
+func TestHandshakePurpose(t *testing.T) {
+	// 响应方按挑战的用途选择密钥，如CLIENT的证明及转发握手
+	proof := MakeProofHandshaker("proof")
+	relay := MakeHandshaker("relay", false)
+	matched, initiatorErr, responderErr := runHandshake(MakeProofHandshaker("proof"), proof, relay)
+	if initiatorErr != nil || responderErr != nil || matched != proof {
+		t.Fatalf("proof handshake: %v, %v, %v", matched, initiatorErr, responderErr)
+	}
+	matched, initiatorErr, responderErr = runHandshake(MakeHandshaker("relay", false), proof, relay)
+	if initiatorErr != nil || responderErr != nil || matched != relay {
+		t.Fatalf("relay handshake: %v, %v, %v", matched, initiatorErr, responderErr)
+	}
+	// 证明密钥不能用于转发握手
+	_, initiatorErr, _ = runHandshake(MakeHandshaker("proof", false), proof, relay)
+	if !errors.Is(initiatorErr, ErrHandshake) {
+		t.Fatalf("proof key as relay key error %v, expected ErrHandshake", initiatorErr)
+	}
+}
+
+func TestHandshakeReplay(t *testing.T) {
+	it := MakeHandshaker("key", false)
+	// 截获的应答不能用于另一次挑战
+	var captured []byte
+	err, _ := initiate(it, func(challenge []byte) []byte {
+		captured = respondAt(it, challenge, time.Now())
+		return captured
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, confirm := initiate(it, func(challenge []byte) []byte {
+		return captured
+	})
+	if !errors.Is(err, ErrHandshake) || len(confirm) != 0 {
+		t.Fatalf("replayed response: %v, %x", err, confirm)
+	}
+	// 已使用的应答nonce
+	if err := checkResponse(captured); !errors.Is(err, ErrHandshake) {
+		t.Fatalf("reused response nonce error %v, expected ErrHandshake", err)
+	}
+}
+
+func TestHandshakeExpired(t *testing.T) {
+	it := MakeHandshaker("key", false)
+	for _, timestamp := range []time.Time{time.Now().Add(-2 * HandshakeMaxSkew), time.Now().Add(2 * HandshakeMaxSkew)} {
+		err, confirm := initiate(it, func(challenge []byte) []byte {
+			return respondAt(it, challenge, timestamp)
+		})
+		if !errors.Is(err, ErrHandshake) || len(confirm) != 0 {
+			t.Fatalf("response at %s: %v, %x", timestamp, err, confirm)
+		}
+	}
+	err, confirm := initiate(it, func(challenge []byte) []byte {
+		return respondAt(it, challenge, time.Now().Add(-HandshakeMaxSkew/2))
+	})
+	if err != nil || len(confirm) != sha256.Size {
+		t.Fatalf("response within the skew: %v, %x", err, confirm)
+	}
+}
+
+func TestHandshakeBadConfirm(t *testing.T) {
+	it := MakeHandshaker("key", false)
+	if err := confirmResponder(it, it); err != nil {
+		t.Fatalf("confirm error: %v", err)
+	}
+	if err := confirmResponder(it, MakeHandshaker("other", false)); !errors.Is(err, ErrHandshake) {
+		t.Fatalf("bad confirm error %v, expected ErrHandshake", err)
+	}
+}
+
+func TestHandshakeLegacy(t *testing.T) {
+	// 兼容旧版本的响应方接受版本1
+	matched, initiatorErr, responderErr := runHandshake(MakeHandshaker("key", true), MakeHandshaker("key", true))
+	if initiatorErr != nil || responderErr != nil {
+		t.Fatalf("legacy handshake error: %v, %v", initiatorErr, responderErr)
+	}
+	if matched == nil {
+		t.Fatal("the legacy handshaker should match")
+	}
+
+	// 不兼容时拒绝版本1
+	_, _, responderErr = runHandshake(MakeHandshaker("key", true), MakeHandshaker("key", false))
+	if !errors.Is(responderErr, ErrHandshake) {
+		t.Fatalf("responder error %v, expected ErrHandshake", responderErr)
+	}
+
+	// 兼容旧版本的响应方也接受版本2
+	_, initiatorErr, responderErr = runHandshake(MakeHandshaker("key", false), MakeHandshaker("key", true))
+	if initiatorErr != nil || responderErr != nil {
+		t.Fatalf("handshake error: %v, %v", initiatorErr, responderErr)
+	}
+}
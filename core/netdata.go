@@ -2,6 +2,7 @@ package core
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 )
 
@@ -17,6 +18,23 @@ type BindRequest struct {
 	Reqeust
 	ClientName string `json:"clientName"`
 	OpenPort   string `json:"openPort"`
+	Weight     int    `json:"weight,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+	Gateway    bool   `json:"gateway,omitempty"`
+	// 秘密绑定的密钥，不为空时不开放端口，OpenPort为绑定名称
+	Secret string `json:"secret,omitempty"`
+	// LAN支持经绑定端口的转发连接（单端口模式）
+	SinglePort bool `json:"singlePort,omitempty"`
+	// LAN支持的握手版本，为空时为版本1
+	HandshakeVersion int `json:"handshakeVersion,omitempty"`
+	// 签名的绑定令牌，WAN设置了令牌密钥时必须
+	Token string `json:"token,omitempty"`
+	// 加密时CLIENT的证明密钥（由加密密钥派生），WAN以此在开放端口验证CLIENT后再使用转发连接
+	ProofKey string `json:"proofKey,omitempty"`
+	// 加密时LAN提供的加密套件（按优先顺序），CLIENT在转发握手后从中选择
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+	// 上次绑定时WAN返回的接管密钥，相同客户端标识的重连以此接管原有的绑定
+	TakeoverKey string `json:"takeoverKey,omitempty"`
 }
 
 type BindResponse struct {
@@ -24,6 +42,56 @@ type BindResponse struct {
 	ClientName   string `json:"clientName"`
 	RelayPort    int    `json:"relayPort"`
 	HandshakeKey string `json:"handshakeKey"`
+	// WAN公布的转发地址（如 "1.1.1.1:50000"），不为空时LAN（TCP）连接此地址，主机为空时使用WAN的地址
+	RelayAddress string `json:"relayAddress,omitempty"`
+	// 单端口模式：不为空时转发连接经绑定端口，以RelayRequest带上此标识
+	BindingID string `json:"bindingId,omitempty"`
+	// 转发连接（HandshakeKey）的握手版本，为空时为版本1
+	HandshakeVersion int `json:"handshakeVersion,omitempty"`
+	// 接管密钥，LAN重连时带上
+	TakeoverKey string `json:"takeoverKey,omitempty"`
+}
+
+// RelayRequest 单端口模式下，LAN经绑定端口（握手后）建立转发连接
+type RelayRequest struct {
+	Reqeust
+	BindingID string `json:"bindingId"`
+}
+
+type StatusRequest struct {
+	Reqeust
+	Available bool `json:"available"`
+}
+
+// 秘密绑定在WAN上的名称前缀
+const SecretBindingPrefix = "secret:"
+
+// VisitRequest CLIENT经绑定端口访问秘密绑定
+type VisitRequest struct {
+	Reqeust
+	SecretName string `json:"secretName"`
+}
+
+// DialRequest 网关模式下请求LAN连接的目标
+type DialRequest struct {
+	Reqeust
+	// 目标地址，如 "10.0.0.1:22"
+	Address string `json:"address"`
+}
+
+// 网关模式下LAN拒绝连接目标时的响应消息
+const DialNotAllowed = "destination not allowed"
+
+// CipherRequest 加密的转发握手后，LAN经控制连接提供加密套件，CLIENT以Response回复选择的套件（或错误）
+type CipherRequest struct {
+	Reqeust
+	Suites []string `json:"suites"`
+}
+
+// CompressRequest 加密的转发握手后，LAN提供可用的压缩方式，CLIENT以Response回复选择的方式（或 "none"）
+type CompressRequest struct {
+	Reqeust
+	Methods []string `json:"methods"`
 }
 
 type UnBindRequest struct {
@@ -31,21 +99,35 @@ type UnBindRequest struct {
 }
 
 func ReadJson2Object(r io.Reader, obj any) error {
+	line, err := ReadJsonLine(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, obj)
+}
+
+// ReadJsonLine 逐字节读取一行（不读入之后的数据）
+func ReadJsonLine(r io.Reader) ([]byte, error) {
 	buff := make([]byte, 0, 1024)
 	tmp := make([]byte, 1)
-	count := 0
 	for {
 		size, err := r.Read(tmp)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		buff = append(buff, tmp[:size]...)
-		count += size
-		if tmp[0] == '\n' {
+		if size > 0 && tmp[0] == '\n' {
 			break
 		}
 	}
-	return json.Unmarshal(buff[:count], obj)
+	return buff, nil
+}
+
+// 是否为JSON格式错误（而非连接错误）
+func IsJsonError(err error) bool {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	return errors.As(err, &syntaxError) || errors.As(err, &typeError)
 }
 
 func WriteObject2Json(w io.Writer, obj any) error {
@@ -0,0 +1,211 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 绑定令牌的签名算法
+const (
+	TokenAlgHS256 = "HS256"
+	TokenAlgEdDSA = "EdDSA"
+)
+
+// Ed25519密钥的前缀，如 "ed25519:<base64>"，私钥64字节用于签发，公钥32字节只能验证
+const TokenKeyEd25519Prefix = "ed25519:"
+
+// ErrToken 令牌无效（格式、算法或签名错误）
+var ErrToken = errors.New("invalid token")
+
+// ErrTokenExpired 令牌已过期
+var ErrTokenExpired = errors.New("token expired")
+
+// TokenClaims 绑定令牌的内容（类似JWT）
+type TokenClaims struct {
+	// LAN的客户端名称，为空时不限制
+	ClientName string `json:"sub,omitempty"`
+	// 允许绑定的开放端口，如 "8080"、"8000-8999"、"secret:name"（秘密绑定）或 "*"
+	OpenPorts []string `json:"ports"`
+	// 过期时间（Unix秒），0为不过期
+	ExpiresAt int64 `json:"exp,omitempty"`
+	// 签发时间（Unix秒）
+	IssuedAt int64 `json:"iat"`
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// TokenKey 签发或验证令牌的密钥：HMAC密钥，或Ed25519的私钥（签发及验证）、公钥（只能验证）
+type TokenKey struct {
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// ParseTokenKey 解析密钥，"ed25519:" 开头时为base64的Ed25519私钥或公钥，否则为HMAC密钥
+func ParseTokenKey(key string) (*TokenKey, error) {
+	if !strings.HasPrefix(key, TokenKeyEd25519Prefix) {
+		if key == "" {
+			return nil, fmt.Errorf("empty token key")
+		}
+		return &TokenKey{secret: []byte(key)}, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(key, TokenKeyEd25519Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("bad ed25519 key: %s", err.Error())
+	}
+	switch len(data) {
+	case ed25519.PrivateKeySize:
+		privateKey := ed25519.PrivateKey(data)
+		return &TokenKey{privateKey: privateKey, publicKey: privateKey.Public().(ed25519.PublicKey)}, nil
+	case ed25519.PublicKeySize:
+		return &TokenKey{publicKey: ed25519.PublicKey(data)}, nil
+	}
+	return nil, fmt.Errorf("bad ed25519 key length %d", len(data))
+}
+
+// GenerateTokenKeyPair 生成Ed25519的私钥及公钥（带 "ed25519:" 前缀）
+func GenerateTokenKeyPair() (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return TokenKeyEd25519Prefix + base64.StdEncoding.EncodeToString(privateKey),
+		TokenKeyEd25519Prefix + base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+func (it *TokenKey) alg() string {
+	if it.secret != nil {
+		return TokenAlgHS256
+	}
+	return TokenAlgEdDSA
+}
+
+// SignToken 签发令牌，格式为 base64url(header).base64url(claims).base64url(签名)
+func SignToken(claims *TokenClaims, key *TokenKey) (string, error) {
+	if key.secret == nil && key.privateKey == nil {
+		return "", fmt.Errorf("the ed25519 public key can not sign tokens")
+	}
+	header, err := json.Marshal(&tokenHeader{Alg: key.alg(), Typ: "tcprp"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signing := encodeTokenPart(header) + "." + encodeTokenPart(payload)
+	var signature []byte
+	if key.secret != nil {
+		signature = tokenHmac(key.secret, signing)
+	} else {
+		signature = ed25519.Sign(key.privateKey, []byte(signing))
+	}
+	return signing + "." + encodeTokenPart(signature), nil
+}
+
+// DecodeToken 解析令牌的算法及内容，不验证签名
+func DecodeToken(token string) (string, *TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, fmt.Errorf("%w: not 3 parts", ErrToken)
+	}
+	header := &tokenHeader{}
+	if err := decodeTokenJson(parts[0], header); err != nil {
+		return "", nil, err
+	}
+	claims := &TokenClaims{}
+	if err := decodeTokenJson(parts[1], claims); err != nil {
+		return "", nil, err
+	}
+	return header.Alg, claims, nil
+}
+
+// VerifyToken 验证令牌的算法、签名及过期时间
+func VerifyToken(token string, key *TokenKey) (*TokenClaims, error) {
+	alg, claims, err := DecodeToken(token)
+	if err != nil {
+		return nil, err
+	}
+	// 算法由密钥决定，不信任令牌声明的算法
+	if alg != key.alg() {
+		return nil, fmt.Errorf("%w: unexpected algorithm %s", ErrToken, alg)
+	}
+	index := strings.LastIndex(token, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(token[index+1:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrToken, err.Error())
+	}
+	if key.secret != nil {
+		if !hmac.Equal(signature, tokenHmac(key.secret, token[:index])) {
+			return nil, fmt.Errorf("%w: bad signature", ErrToken)
+		}
+	} else if !ed25519.Verify(key.publicKey, []byte(token[:index]), signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrToken)
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// AllowOpenPort 是否允许绑定开放端口，openPort如 ":8080"、"0.0.0.0:8080" 或 "secret:name"
+func (it *TokenClaims) AllowOpenPort(openPort string) bool {
+	port := openPort
+	if !strings.HasPrefix(openPort, SecretBindingPrefix) {
+		if _, p, err := net.SplitHostPort(openPort); err == nil {
+			port = p
+		}
+	}
+	for _, allowed := range it.OpenPorts {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || allowed == port {
+			return true
+		}
+		// 端口范围
+		from, to, found := strings.Cut(allowed, "-")
+		if !found || strings.HasPrefix(port, SecretBindingPrefix) {
+			continue
+		}
+		min, err1 := strconv.Atoi(from)
+		max, err2 := strconv.Atoi(to)
+		value, err3 := strconv.Atoi(port)
+		if err1 == nil && err2 == nil && err3 == nil && value >= min && value <= max {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenHmac(secret []byte, signing string) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(signing))
+	return m.Sum(nil)
+}
+
+func encodeTokenPart(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeTokenJson(part string, obj any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrToken, err.Error())
+	}
+	if err := json.Unmarshal(data, obj); err != nil {
+		return fmt.Errorf("%w: %s", ErrToken, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustTokenKey(t *testing.T, key string) *TokenKey {
+	tokenKey, err := ParseTokenKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenKey
+}
+
+func TestTokenSignVerify(t *testing.T) {
+	privateKey, publicKey, err := GenerateTokenKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		sign   *TokenKey
+		verify *TokenKey
+	}{
+		{mustTokenKey(t, "secret"), mustTokenKey(t, "secret")},
+		{mustTokenKey(t, privateKey), mustTokenKey(t, publicKey)},
+		{mustTokenKey(t, privateKey), mustTokenKey(t, privateKey)},
+	}
+	for _, c := range cases {
+		token, err := SignToken(&TokenClaims{ClientName: "lan", OpenPorts: []string{"8080"}, IssuedAt: time.Now().Unix()}, c.sign)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := VerifyToken(token, c.verify)
+		if err != nil {
+			t.Fatalf("%s token error: %v", c.verify.alg(), err)
+		}
+		if claims.ClientName != "lan" || !claims.AllowOpenPort(":8080") {
+			t.Fatalf("unexpected claims %+v", claims)
+		}
+	}
+
+	// 公钥不能签发
+	if _, err := SignToken(&TokenClaims{}, mustTokenKey(t, publicKey)); err == nil {
+		t.Fatal("the public key should not sign tokens")
+	}
+}
+
+func TestTokenBadSignature(t *testing.T) {
+	token, _ := SignToken(&TokenClaims{OpenPorts: []string{"*"}}, mustTokenKey(t, "secret"))
+	if _, err := VerifyToken(token, mustTokenKey(t, "other")); !errors.Is(err, ErrToken) {
+		t.Fatalf("wrong secret error %v, expected ErrToken", err)
+	}
+
+	// 修改内容后签名不符
+	parts := strings.Split(token, ".")
+	parts[1] = encodeTokenPart([]byte(`{"ports":["*"],"iat":1,"sub":"admin"}`))
+	if _, err := VerifyToken(strings.Join(parts, "."), mustTokenKey(t, "secret")); !errors.Is(err, ErrToken) {
+		t.Fatalf("modified claims error %v, expected ErrToken", err)
+	}
+
+	if _, err := VerifyToken("a.b", mustTokenKey(t, "secret")); !errors.Is(err, ErrToken) {
+		t.Fatalf("malformed token error %v, expected ErrToken", err)
+	}
+}
+
+func TestTokenAlgorithmPinning(t *testing.T) {
+	_, publicKey, _ := GenerateTokenKeyPair()
+	verifyKey := mustTokenKey(t, publicKey)
+
+	// 以公钥为HMAC密钥伪造的HS256令牌
+	header := encodeTokenPart([]byte(`{"alg":"HS256","typ":"tcprp"}`))
+	payload := encodeTokenPart([]byte(`{"ports":["*"],"iat":1}`))
+	m := hmac.New(sha256.New, []byte(publicKey))
+	m.Write([]byte(header + "." + payload))
+	forged := header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+	if _, err := VerifyToken(forged, verifyKey); !errors.Is(err, ErrToken) {
+		t.Fatalf("HS256 token with an ed25519 key error %v, expected ErrToken", err)
+	}
+
+	// 无签名的令牌
+	none := encodeTokenPart([]byte(`{"alg":"none","typ":"tcprp"}`)) + "." + payload + "."
+	if _, err := VerifyToken(none, verifyKey); !errors.Is(err, ErrToken) {
+		t.Fatalf("none token error %v, expected ErrToken", err)
+	}
+	if _, err := VerifyToken(none, mustTokenKey(t, "secret")); !errors.Is(err, ErrToken) {
+		t.Fatalf("none token error %v, expected ErrToken", err)
+	}
+
+	// EdDSA令牌不能以HMAC密钥验证
+	privateKey, _, _ := GenerateTokenKeyPair()
+	token, _ := SignToken(&TokenClaims{OpenPorts: []string{"*"}}, mustTokenKey(t, privateKey))
+	if _, err := VerifyToken(token, mustTokenKey(t, "secret")); !errors.Is(err, ErrToken) {
+		t.Fatalf("EdDSA token with an HMAC key error %v, expected ErrToken", err)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	key := mustTokenKey(t, "secret")
+	expired, _ := SignToken(&TokenClaims{OpenPorts: []string{"*"}, ExpiresAt: time.Now().Add(-time.Minute).Unix()}, key)
+	if _, err := VerifyToken(expired, key); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expired token error %v, expected ErrTokenExpired", err)
+	}
+	valid, _ := SignToken(&TokenClaims{OpenPorts: []string{"*"}, ExpiresAt: time.Now().Add(time.Minute).Unix()}, key)
+	if _, err := VerifyToken(valid, key); err != nil {
+		t.Fatalf("valid token error: %v", err)
+	}
+	forever, _ := SignToken(&TokenClaims{OpenPorts: []string{"*"}}, key)
+	if _, err := VerifyToken(forever, key); err != nil {
+		t.Fatalf("token without expiry error: %v", err)
+	}
+}
+
+func TestTokenAllowOpenPort(t *testing.T) {
+	claims := &TokenClaims{OpenPorts: []string{"8080", "9000-9010", SecretBindingPrefix + "db"}}
+	cases := map[string]bool{
+		":8080":                       true,
+		"0.0.0.0:8080":                true,
+		":8081":                       false,
+		":9005":                       true,
+		":9011":                       false,
+		SecretBindingPrefix + "db":    true,
+		SecretBindingPrefix + "other": false,
+	}
+	for openPort, allowed := range cases {
+		if claims.AllowOpenPort(openPort) != allowed {
+			t.Fatalf("AllowOpenPort(%s) should be %v", openPort, allowed)
+		}
+	}
+	if !(&TokenClaims{OpenPorts: []string{"*"}}).AllowOpenPort(":1") {
+		t.Fatal("* should allow any port")
+	}
+}
+
+func TestParseTokenKey(t *testing.T) {
+	if _, err := ParseTokenKey(""); err == nil {
+		t.Fatal("empty token key should fail")
+	}
+	if _, err := ParseTokenKey(TokenKeyEd25519Prefix + base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+		t.Fatal("bad ed25519 key length should fail")
+	}
+}
@@ -0,0 +1,694 @@
+package lan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"tcp-tunnel/config"
+	"tcp-tunnel/core"
+	"tcp-tunnel/logger"
+	nets "tcp-tunnel/net"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Agent LAN端，绑定WAN的开放端口并转发到应用
+type Agent struct {
+
+	// 设置
+	connectTimeout      int
+	relayIoTimeout      int
+	maxReadyConnect     int
+	keepaliveConnection int
+	// 地址
+	clientName string
+	token      string
+	// CLIENT的证明密钥，为空时WAN不验证CLIENT
+	proofKey        string
+	serverAddresses []*serverAddress
+	serverPolicy    string
+	// 连接WAN（可经代理）
+	dialer    *nets.Dialer
+	failback  int
+	openPort  string
+	weight    int
+	secretKey string
+	backends  *backendPool
+
+	// 当前绑定的服务端（bindLock保护）
+	activeServer  *serverAddress
+	bindConn      net.Conn
+	bindLock      sync.Locker
+	bindWriteLock sync.Locker
+
+	handshaker      *core.Handshaker
+	log             *logger.Logger
+	encryptKey      *core.EncryptKey
+	relayHandshaker *core.Handshaker
+	// 可提供给CLIENT的加密套件及压缩方式
+	cipherSuites []string
+	compression  []string
+
+	// 待命连接计数
+	readyConnect int
+	readyLock    sync.Locker
+	// 待命连接（绑定断开时关闭）
+	readyConns *core.SyncMap
+	// 正在转发的连接
+	sessions *core.SyncMap
+	// 网关模式（为空时转发到应用地址）
+	gateway *gateway
+
+	useTls bool
+	events Events
+	// 关闭信号
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+const (
+	// ServerPolicyPriority 按顺序优先绑定靠前的服务端
+	ServerPolicyPriority = "priority"
+	// ServerPolicyRoundRobin 轮流绑定各个服务端
+	ServerPolicyRoundRobin = "round-robin"
+)
+
+// NewAgent 按配置创建LAN端，调用Run开始绑定
+func NewAgent(config Config) (*Agent, error) {
+	dialer, err := nets.NewDialer(config.Proxy, time.Duration(config.ConnectTimeout)*time.Second)
+	if err != nil {
+		return nil, &core.ConfigError{Field: "Proxy", Message: "bad proxy: " + err.Error()}
+	}
+	serverAddresses, applicationAddresses, openAddress, gatewayRules, err := config.check(dialer.Proxy == nil)
+	if err != nil {
+		return nil, err
+	}
+	log := config.Log
+	if log == nil {
+		log = logger.NewLogger("LAN", logger.LevelInfo, nil)
+	}
+
+	// 未指定则使用令牌中的名称或每个进程随机一个标识
+	clientName := config.ClientName
+	if clientName == "" && config.Token != "" {
+		_, claims, _ := core.DecodeToken(config.Token)
+		clientName = claims.ClientName
+	}
+	if clientName == "" {
+		clientName = uuid.New().String()
+	}
+
+	// 加密密钥（口令派生耗时，只派生一次）
+	var encryptKey *core.EncryptKey
+	if config.EncryptKey != "" {
+		encryptKey, err = core.ParseEncryptKey(config.EncryptKey, config.EncryptSalt, config.LegacyHandshake)
+		if err != nil {
+			return nil, &core.ConfigError{Field: "EncryptKey", Message: err.Error()}
+		}
+		// 旧版本的握手没有每个连接的密钥，只能使用旧版本方式的口令
+		if config.LegacyHandshake && !encryptKey.Legacy() {
+			return nil, &core.ConfigError{Field: "EncryptKey", Message: "The legacy handshake can not use a raw key or key file"}
+		}
+	}
+
+	log = log.With("binding", openAddress)
+	it := &Agent{
+		clientName: clientName,
+		token:      config.Token,
+		proofKey: func() string {
+			// 旧版本的CLIENT不支持证明
+			if encryptKey != nil && !config.LegacyHandshake {
+				return encryptKey.ProofKey()
+			}
+			return ""
+		}(),
+		serverAddresses:     serverAddresses,
+		serverPolicy:        config.ServerPolicy,
+		dialer:              dialer,
+		failback:            config.Failback,
+		connectTimeout:      config.ConnectTimeout,
+		relayIoTimeout:      config.IoTimeout,
+		keepaliveConnection: config.Keepalive,
+		maxReadyConnect:     config.ReadyConnections,
+		readyLock:           &sync.Mutex{},
+		readyConnect:        0,
+		readyConns:          core.MakeSyncMap(config.ReadyConnections),
+		sessions:            core.MakeSyncMap(16),
+		openPort:            openAddress,
+		weight:              config.Weight,
+		secretKey:           config.SecretKey,
+		backends:            makeBackendPool(applicationAddresses, config.BackendPolicy, config.ConnectTimeout, config.HealthInterval, log),
+		bindLock:            &sync.Mutex{},
+		bindWriteLock:       &sync.Mutex{},
+		log:                 log,
+		handshaker:          core.MakeHandshaker(config.HandshakeKey, config.LegacyHandshake),
+		encryptKey:          encryptKey,
+		cipherSuites: func() []string {
+			if encryptKey != nil && len(config.CipherSuites) == 0 {
+				return core.DefaultCipherSuites()
+			}
+			return config.CipherSuites
+		}(),
+		compression: config.Compression,
+		relayHandshaker: func() *core.Handshaker {
+			if encryptKey != nil {
+				return core.MakeHandshaker(encryptKey.HandshakeKey(), config.LegacyHandshake)
+			}
+			return nil
+		}(),
+		useTls: config.Tls,
+		events: config.Events,
+		done:   make(chan struct{}),
+	}
+
+	if config.Gateway {
+		it.gateway = &gateway{rules: gatewayRules, connectTimeout: config.ConnectTimeout}
+	}
+
+	// 应用地址的健康检查，可用状态改变时通知服务端
+	it.backends.availableCallback = func(available bool) {
+		it.writeBindStatus(it.getBindConn(), "status")
+	}
+	return it, nil
+}
+
+// Run 绑定WAN并转发，断开后自动重连，直到ctx取消或调用Close
+// 返回 ctx.Err() 或 core.ErrClosed
+func (it *Agent) Run(ctx context.Context) error {
+	if it.isClosed() {
+		return core.ErrClosed
+	}
+
+	// ctx取消时关闭
+	go func() {
+		select {
+		case <-ctx.Done():
+			it.Close()
+		case <-it.done:
+		}
+	}()
+
+	go it.backends.loopHealthCheck(it.done)
+
+	// 循环重试（直到绑定到服务端）
+	next := 0
+	failCount := 0
+	for !it.isClosed() {
+
+		// 本次绑定是否断开（保活及读取的协程设置）
+		closed := &atomic.Bool{}
+		// 连接和绑定
+		serverAddress := it.serverAddresses[next]
+		bindResponse, err := it.connectAndBind(serverAddress, it.useTls, func() { closed.Store(true) })
+		if err != nil {
+			if it.events.OnBindError != nil && !it.isClosed() {
+				it.events.OnBindError(serverAddress.String(), err)
+			}
+			// 失败则尝试下一个服务端，全部失败后等待重试
+			failCount++
+			next = (next + 1) % len(it.serverAddresses)
+			if failCount%len(it.serverAddresses) == 0 {
+				it.sleep(5 * time.Second) // 重试
+			}
+			continue
+		}
+		failCount = 0
+
+		// 切换当前服务端
+		if it.getActiveServer() != serverAddress {
+			it.log.Info("active server", serverAddress.String(), "-", it.openPort)
+		}
+		it.bindLock.Lock()
+		it.activeServer = serverAddress
+		it.bindLock.Unlock()
+		if it.events.OnBind != nil {
+			it.events.OnBind(serverAddress.String())
+		}
+
+		// 非首选服务端时，检测首选服务端是否恢复
+		if it.serverPolicy == ServerPolicyPriority && next != 0 && it.failback > 0 {
+			go it.loopFailback(closed)
+		}
+
+		// 运行循环器
+		it.loopRelayConnect(bindResponse, closed)
+		it.getBindConn().Close()
+		if !it.isClosed() {
+			it.log.Warn("binding broken on server", serverAddress.String(), "-", it.openPort)
+		}
+		if it.events.OnUnbind != nil {
+			it.events.OnUnbind(serverAddress.String())
+		}
+
+		// 关闭未使用的待命连接，避免占用新服务端的待命数量
+		it.readyConns.Range(func(key, value interface{}) bool {
+			key.(net.Conn).Close()
+			return true
+		})
+
+		// 选择下一个服务端
+		if it.serverPolicy == ServerPolicyRoundRobin {
+			next = (next + 1) % len(it.serverAddresses)
+		} else {
+			next = 0
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return core.ErrClosed
+}
+
+// Close 断开绑定及正在转发的连接
+func (it *Agent) Close() error {
+	it.closeOnce.Do(func() {
+		close(it.done)
+		if bindConn := it.getBindConn(); bindConn != nil {
+			bindConn.Close()
+		}
+		it.readyConns.Range(func(key, value interface{}) bool {
+			key.(net.Conn).Close()
+			return true
+		})
+		it.sessions.Range(func(key, value interface{}) bool {
+			key.(net.Conn).Close()
+			return true
+		})
+	})
+	return nil
+}
+
+// 当前绑定的服务端
+func (it *Agent) getActiveServer() *serverAddress {
+	it.bindLock.Lock()
+	defer it.bindLock.Unlock()
+	return it.activeServer
+}
+
+// 当前的绑定连接
+func (it *Agent) getBindConn() net.Conn {
+	it.bindLock.Lock()
+	defer it.bindLock.Unlock()
+	return it.bindConn
+}
+
+func (it *Agent) isClosed() bool {
+	select {
+	case <-it.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 等待一段时间，关闭时立即返回
+func (it *Agent) sleep(duration time.Duration) {
+	select {
+	case <-it.done:
+	case <-time.After(duration):
+	}
+}
+
+// 周期检测首选服务端，恢复后断开当前绑定以切换回首选服务端
+func (it *Agent) loopFailback(closed *atomic.Bool) {
+	primary := it.serverAddresses[0]
+	for !closed.Load() {
+		it.sleep(time.Duration(it.failback) * time.Second)
+		if closed.Load() || it.isClosed() {
+			break
+		}
+		if err := primary.probe(it.dialer); err != nil {
+			it.log.Debug("primary server is still unavailable:", err.Error())
+			continue
+		}
+		it.log.Info("primary server", primary.String(), "recovered, move back from", it.getActiveServer().String())
+		it.getBindConn().Close()
+		break
+	}
+}
+
+func (it *Agent) connectAndBind(serverAddress *serverAddress, useTls bool, bindCloseCallback func()) (*core.BindResponse, error) {
+
+	var bindConn net.Conn
+	var err error
+
+	// 连接绑定服务端
+	it.log.Debug("connect to bind server", serverAddress.String(), "-", it.openPort)
+	if it.dialer.Proxy != nil {
+		it.log.Debug("through proxy", it.dialer.Proxy.Redacted())
+	}
+	bindConn, err = serverAddress.dialBind(it.dialer, useTls)
+	if err != nil {
+		it.log.Error(err, "bind connect error")
+		return nil, err
+	}
+
+	// 绑定连接的握手，之后的请求及响应经控制连接（加密）
+	controlConn, err := it.handshaker.RwControlHandshake(bindConn, config.WaitTimeout)
+	if err != nil {
+		it.log.Debug("bind handshake error:", err.Error())
+		bindConn.Close()
+		return nil, err
+	}
+	bindConn = controlConn
+
+	// 发送绑定请求
+	if err := core.WriteObject2Json(bindConn, &core.BindRequest{
+		Reqeust:    core.Reqeust{Action: "bind"},
+		ClientName: it.clientName,
+		OpenPort:   it.openPort,
+		Weight:     it.weight,
+		Encrypted:  it.encryptKey != nil,
+		Gateway:    it.gateway != nil,
+		Secret:     it.secretKey,
+		Token:      it.token,
+		// 证明密钥只经加密的控制连接或TLS发送
+		ProofKey: func() string {
+			if controlConn.Encrypted() || useTls {
+				return it.proofKey
+			}
+			return ""
+		}(),
+		// 加密套件
+		CipherSuites: it.cipherSuites,
+		SinglePort:   true,
+		// 握手版本
+		HandshakeVersion: core.HandshakeVersion,
+		// 接管断开前的绑定
+		TakeoverKey: serverAddress.getTakeoverKey(),
+	}); err != nil {
+		it.log.Error(err, "write bind request error")
+		bindConn.Close()
+		return nil, err
+	}
+
+	// 读取bind命令
+	bindResponse := &core.BindResponse{}
+	if err := core.ReadJson2Object(bindConn, &bindResponse); err != nil {
+		it.log.Error(err, "read bind response error")
+		bindConn.Close()
+		return nil, err
+	}
+
+	// 绑定失败
+	if bindResponse.Message != "success" {
+		it.log.Error(errors.New(bindResponse.Message), "bind open port error", it.openPort)
+		bindConn.Close()
+		return nil, &core.BindError{OpenPort: it.openPort, Message: bindResponse.Message}
+	}
+	serverAddress.takeoverKey.Store(&bindResponse.TakeoverKey)
+
+	// 应用不可用时通知服务端
+	if !it.backends.isAvailable() {
+		it.writeBindStatus(bindConn, "status")
+	}
+
+	// 长连接，断开则关闭代理
+	it.bindLock.Lock()
+	it.bindConn = bindConn
+	it.bindLock.Unlock()
+	go func() {
+		defer bindConn.Close()
+		defer bindCloseCallback()
+		go func() {
+			defer bindConn.Close()
+			defer bindCloseCallback()
+			for {
+				it.sleep(time.Duration(it.keepaliveConnection) * time.Second)
+				if it.isClosed() {
+					break
+				}
+				err := it.writeBindStatus(bindConn, "keepalive")
+				if err != nil {
+					break
+				}
+			}
+		}()
+		for {
+			statusRequest := &core.StatusRequest{}
+			err := core.ReadJson2Object(bindConn, statusRequest)
+			if err != nil {
+				if core.IsJsonError(err) {
+					continue
+				}
+				it.log.Debug("break bind:", err.Error())
+				break
+			}
+			it.log.Trace("bind keepalive package:", statusRequest.Action, "-", serverAddress.String())
+		}
+	}()
+
+	// 返回
+	return bindResponse, nil
+}
+
+// 向服务端发送应用的可用状态
+func (it *Agent) writeBindStatus(bindConn net.Conn, action string) error {
+	if bindConn == nil {
+		return nil
+	}
+	it.bindWriteLock.Lock()
+	defer it.bindWriteLock.Unlock()
+	available := it.backends.isAvailable()
+	if action == "status" {
+		it.log.Info("notify server application available:", strconv.FormatBool(available), "-", it.openPort)
+	}
+	return core.WriteObject2Json(bindConn, &core.StatusRequest{
+		Reqeust:   core.Reqeust{Action: action},
+		Available: available,
+	})
+}
+
+//// 以下是转发连接的实现部分 /////////////////////////////////////////////////////////////////////////////////
+
+type relayConnectionBundle struct {
+	relayConn  net.Conn
+	handshaker *core.Handshaker
+}
+
+// 循环尝试连接服务端转发端口
+func (it *Agent) loopRelayConnect(bindResponse *core.BindResponse, closed *atomic.Bool) {
+	var relayConn net.Conn
+	var errCount = 0
+	for !closed.Load() && !it.isClosed() {
+
+		// 准备连接已满，等待
+		if it.getReady() >= it.maxReadyConnect {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		// 连接服务端
+		var err error
+		if bindResponse.BindingID != "" {
+			relayConn, err = it.dialSinglePortRelay(bindResponse.BindingID)
+		} else {
+			relayConn, err = it.getActiveServer().dialRelay(it.dialer, bindResponse.RelayPort, bindResponse.RelayAddress)
+		}
+		if err != nil { // 连接失败
+			errCount++
+			it.log.Error(err, "connect to relay server error", fmt.Sprintf("[%d/%d]", it.getReady()+1, it.maxReadyConnect))
+			if errCount <= 3 {
+				it.sleep(100 * time.Millisecond)
+			} else if errCount <= 8 {
+				it.sleep(1000 * time.Millisecond)
+			} else {
+				it.sleep(5000 * time.Millisecond)
+			}
+			continue // 去重试
+		}
+
+		// 连接成功
+		it.log.Debug("connect to relay server", relayConn.LocalAddr().String(), "->", relayConn.RemoteAddr().String(), fmt.Sprintf("[%d/%d]", it.getReady()+1, it.maxReadyConnect), "-", it.openPort)
+
+		// 增待命连接数
+		it.addReady()
+
+		// 处理转发连接
+		go it.handleRelayConnection(&relayConnectionBundle{relayConn: relayConn, handshaker: core.MakeHandshaker(bindResponse.HandshakeKey, bindResponse.HandshakeVersion < core.HandshakeVersion)})
+	}
+
+}
+
+// 单端口模式：经绑定端口建立转发连接，握手后以绑定标识声明为转发连接
+func (it *Agent) dialSinglePortRelay(bindingID string) (net.Conn, error) {
+	relayConn, err := it.getActiveServer().dialRelayBind(it.dialer, it.useTls)
+	if err != nil {
+		return nil, err
+	}
+	controlConn, err := it.handshaker.RwControlHandshake(relayConn, config.WaitTimeout)
+	if err != nil {
+		relayConn.Close()
+		return nil, err
+	}
+	if err := core.WriteObject2Json(controlConn, &core.RelayRequest{
+		Reqeust:   core.Reqeust{Action: "relay"},
+		BindingID: bindingID,
+	}); err != nil {
+		relayConn.Close()
+		return nil, err
+	}
+	return relayConn, nil
+}
+
+func (it *Agent) handleRelayConnection(bundle *relayConnectionBundle) {
+	// 关闭转发连接
+	defer bundle.relayConn.Close()
+
+	// 是否握手失败
+	it.readyConns.Put(bundle.relayConn, true)
+	if func() bool {
+		defer it.readyConns.Delete(bundle.relayConn)
+		defer it.subReady() // 握手成功或失败后减少待命连接数
+		err := bundle.handshaker.RwHandshake(bundle.relayConn, 0)
+		if err != nil {
+			it.log.Debug("handshake error:", err.Error())
+			return true
+		}
+		return false
+	}() {
+		return
+	}
+
+	// 开始转发
+	it.startRelay(bundle)
+}
+
+// 转发 relayAddress <-> applicationAddress
+func (it *Agent) startRelay(bundle *relayConnectionBundle) {
+
+	record := &logger.AccessRecord{
+		SessionID:  uuid.New().String(),
+		OpenPort:   it.openPort,
+		LanAddress: bundle.relayConn.LocalAddr().String(),
+		StartTime:  time.Now(),
+		Encrypted:  it.encryptKey != nil,
+	}
+	log := it.log.With("session", record.SessionID)
+
+	// 请求应用服务器，网关模式在握手后按请求连接目标
+	var applicationConn net.Conn
+	var err error
+	if it.gateway == nil {
+		var backend *backend
+		applicationConn, backend, err = it.backends.dial()
+		if err != nil {
+			log.Debug("connect to application error:", err.Error())
+			return
+		}
+		log.Debug("connect to application", applicationConn.LocalAddr().String(), "->", applicationConn.RemoteAddr().String())
+		backend.addActive(1)
+		defer backend.addActive(-1)
+	}
+
+	// 退出转发
+	it.sessions.Put(bundle.relayConn, true)
+	defer func() {
+		it.sessions.Delete(bundle.relayConn)
+		if applicationConn != nil {
+			applicationConn.Close()
+			log.Debug("break", bundle.relayConn.LocalAddr().String(), "</>", applicationConn.LocalAddr().String())
+		}
+	}()
+
+	// 加解密处理器
+	var cryptor core.Cryptor
+	if it.encryptKey != nil {
+		// 加密连接的握手，之后经控制连接协商加密套件（旧版本的握手不协商）
+		controlConn, err := it.relayHandshaker.WrControlHandshake(bundle.relayConn, config.WaitTimeout)
+		if err != nil {
+			log.Debug("relay handshake error:", err.Error())
+			return
+		}
+		suite := core.CipherChaCha20
+		if controlConn.Encrypted() {
+			suite, err = nets.OfferCipherSuite(controlConn, it.cipherSuites, config.WaitTimeout)
+			if err != nil {
+				log.Debug("negotiate cipher suite error:", err.Error())
+				return
+			}
+		}
+		cryptor, err = it.encryptKey.NewCryptor(suite, controlConn)
+		if err != nil {
+			log.Debug("make cryptor error", err.Error())
+			return
+		}
+		record.Encrypted = cryptor != nil
+		record.Cipher = suite
+	}
+
+	// 协商压缩方式
+	var compressor core.Compressor
+	if len(it.compression) > 0 {
+		compressor, err = nets.OfferCompression(nets.NewCryptConn(bundle.relayConn, cryptor), it.compression, config.WaitTimeout)
+		if err != nil {
+			log.Debug("negotiate compression error:", err.Error())
+			return
+		}
+		if compressor != nil {
+			defer compressor.Close()
+			record.Compression = compressor.Name()
+		}
+	}
+
+	// 网关模式：读取请求的目标，检查白名单后连接
+	if it.gateway != nil {
+		applicationConn, record.Destination, err = it.gateway.dial(nets.NewCryptConn(bundle.relayConn, cryptor))
+		if err != nil {
+			log.Debug("gateway dial error:", err.Error())
+			if record.Destination != "" {
+				record.CloseReason = "gateway " + err.Error()
+				it.access(record)
+			}
+			return
+		}
+		log.Debug("connect to destination", record.Destination, applicationConn.LocalAddr().String(), "->", applicationConn.RemoteAddr().String())
+	}
+
+	// 转发
+	log.Debug("relay", bundle.relayConn.LocalAddr().String(), "<->", applicationConn.LocalAddr().String())
+	record.ApplicationAddress = applicationConn.RemoteAddr().String()
+	stats := nets.Relay(applicationConn, bundle.relayConn, it.relayIoTimeout, cryptor, compressor)
+
+	// 访问记录
+	record.BytesFromClient = stats.Bytes21
+	record.BytesToClient = stats.Plain12
+	if compressor != nil {
+		record.CompressRatio = stats.CompressRatio()
+	}
+	record.CloseReason = stats.CloseReason("application", "relay")
+	it.access(record)
+}
+
+// 输出访问记录
+func (it *Agent) access(record *logger.AccessRecord) {
+	record.EndTime = time.Now()
+	it.log.Access(record)
+	if it.events.OnSession != nil {
+		it.events.OnSession(record)
+	}
+}
+
+func (it *Agent) addReady() {
+	it.readyLock.Lock()
+	defer it.readyLock.Unlock()
+	it.readyConnect++
+}
+
+func (it *Agent) subReady() {
+	it.readyLock.Lock()
+	defer it.readyLock.Unlock()
+	it.readyConnect--
+}
+
+func (it *Agent) getReady() int {
+	it.readyLock.Lock()
+	defer it.readyLock.Unlock()
+	return it.readyConnect
+}
@@ -0,0 +1,184 @@
+package lan
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"tcp-tunnel/logger"
+	"time"
+)
+
+const (
+	// BackendPolicyRoundRobin 轮流使用各个应用地址
+	BackendPolicyRoundRobin = "round-robin"
+	// BackendPolicyLeastConn 优先使用转发连接最少的应用地址
+	BackendPolicyLeastConn = "least-conn"
+)
+
+// 应用地址
+type backend struct {
+	// *net.TCPAddr 或 *net.UnixAddr
+	address net.Addr
+	// 健康状态
+	healthy int32
+	// 正在转发的连接数
+	activeConns int32
+}
+
+func (it *backend) isHealthy() bool {
+	return atomic.LoadInt32(&it.healthy) == 1
+}
+
+// 设置健康状态，返回状态是否改变
+func (it *backend) setHealthy(healthy bool) bool {
+	var v int32 = 0
+	if healthy {
+		v = 1
+	}
+	return atomic.SwapInt32(&it.healthy, v) != v
+}
+
+func (it *backend) addActive(delta int32) {
+	atomic.AddInt32(&it.activeConns, delta)
+}
+
+func (it *backend) active() int32 {
+	return atomic.LoadInt32(&it.activeConns)
+}
+
+// 应用地址池
+type backendPool struct {
+	backends       []*backend
+	policy         string
+	connectTimeout int
+	healthInterval int
+	log            *logger.Logger
+	next           int
+	lock           sync.Locker
+	// 是否有健康的应用地址
+	available int32
+	// 可用状态改变的回调
+	availableCallback func(available bool)
+}
+
+func makeBackendPool(
+	addresses []net.Addr,
+	policy string,
+	connectTimeout int,
+	healthInterval int,
+	log *logger.Logger,
+) *backendPool {
+	it := &backendPool{
+		policy:         policy,
+		connectTimeout: connectTimeout,
+		healthInterval: healthInterval,
+		log:            log,
+		lock:           &sync.Mutex{},
+		available:      1,
+	}
+	for _, address := range addresses {
+		it.backends = append(it.backends, &backend{address: address, healthy: 1})
+	}
+	return it
+}
+
+// 是否有健康的应用地址
+func (it *backendPool) isAvailable() bool {
+	return atomic.LoadInt32(&it.available) == 1
+}
+
+// 按策略排列健康的应用地址，首个为优先选择
+func (it *backendPool) pick() []*backend {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+
+	backends := make([]*backend, 0, len(it.backends))
+	it.next = (it.next + 1) % len(it.backends)
+	for i := 0; i < len(it.backends); i++ {
+		backend := it.backends[(it.next+i)%len(it.backends)]
+		if backend.isHealthy() {
+			backends = append(backends, backend)
+		}
+	}
+	if it.policy == BackendPolicyLeastConn {
+		sort.SliceStable(backends, func(i, j int) bool {
+			return backends[i].active() < backends[j].active()
+		})
+	}
+	return backends
+}
+
+// 连接一个可用的应用地址，失败时尝试下一个
+func (it *backendPool) dial() (net.Conn, *backend, error) {
+	for _, backend := range it.pick() {
+		conn, err := net.DialTimeout(backend.address.Network(), backend.address.String(), time.Duration(it.connectTimeout)*time.Second)
+		if err != nil {
+			it.log.Debug("connect to application error:", err.Error())
+			// 开启健康检查时，连接失败即标记为不健康，由健康检查恢复
+			if it.healthInterval > 0 {
+				it.markHealthy(backend, false)
+			}
+			continue
+		}
+		return conn, backend, nil
+	}
+	return nil, nil, fmt.Errorf("no healthy application address")
+}
+
+// 更新健康状态
+func (it *backendPool) markHealthy(backend *backend, healthy bool) {
+	if !backend.setHealthy(healthy) {
+		return
+	}
+	if healthy {
+		it.log.Info("application", backend.address.String(), "is healthy")
+	} else {
+		it.log.Warn("application", backend.address.String(), "is unhealthy")
+	}
+
+	// 汇总可用状态
+	it.lock.Lock()
+	available := false
+	for _, b := range it.backends {
+		if b.isHealthy() {
+			available = true
+			break
+		}
+	}
+	var v int32 = 0
+	if available {
+		v = 1
+	}
+	changed := atomic.SwapInt32(&it.available, v) != v
+	it.lock.Unlock()
+
+	if changed && it.availableCallback != nil {
+		it.availableCallback(available)
+	}
+}
+
+// 循环检查应用地址的健康状态，done关闭时退出
+func (it *backendPool) loopHealthCheck(done <-chan struct{}) {
+	if it.healthInterval <= 0 {
+		return
+	}
+	for {
+		for _, backend := range it.backends {
+			conn, err := net.DialTimeout(backend.address.Network(), backend.address.String(), time.Duration(it.connectTimeout)*time.Second)
+			if err != nil {
+				it.log.Debug("health check error:", err.Error())
+				it.markHealthy(backend, false)
+				continue
+			}
+			conn.Close()
+			it.markHealthy(backend, true)
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(it.healthInterval) * time.Second):
+		}
+	}
+}
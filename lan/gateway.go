@@ -0,0 +1,144 @@
+package lan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"tcp-tunnel/config"
+	"tcp-tunnel/core"
+	"time"
+)
+
+// 网关的目标白名单规则
+type gatewayRule struct {
+	network *net.IPNet
+	// 端口范围，均为0时不限端口
+	fromPort int
+	toPort   int
+}
+
+// 解析白名单规则，格式为 CIDR 或 CIDR:端口 或 CIDR:起始端口-结束端口，
+// 如 "10.0.0.0/8:22"、"192.168.1.0/24:8000-8999"、"[fd00::/8]:443"，单个IP视为/32或/128
+func parseGatewayRule(text string) (*gatewayRule, error) {
+	text = strings.TrimSpace(text)
+	network, ports := text, ""
+	if strings.HasPrefix(text, "[") {
+		end := strings.Index(text, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("bad gateway rule %s", text)
+		}
+		network, ports = text[1:end], strings.TrimPrefix(text[end+1:], ":")
+	} else if strings.Count(text, ":") == 1 {
+		network, ports, _ = strings.Cut(text, ":")
+	}
+
+	it := &gatewayRule{}
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("bad gateway rule %s", text)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		it.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("bad gateway rule %s", text)
+		}
+		it.network = ipNet
+	}
+
+	if ports != "" && ports != "*" {
+		from, to, isRange := strings.Cut(ports, "-")
+		var err1, err2 error
+		it.fromPort, err1 = strconv.Atoi(from)
+		it.toPort, err2 = it.fromPort, nil
+		if isRange {
+			it.toPort, err2 = strconv.Atoi(to)
+		}
+		if err1 != nil || err2 != nil || it.fromPort < 1 || it.toPort > 65535 || it.fromPort > it.toPort {
+			return nil, fmt.Errorf("bad gateway rule %s", text)
+		}
+	}
+	return it, nil
+}
+
+func (it *gatewayRule) allow(ip net.IP, port int) bool {
+	if !it.network.Contains(ip) {
+		return false
+	}
+	return it.fromPort == 0 || (port >= it.fromPort && port <= it.toPort)
+}
+
+// 网关模式：按用户请求的目标连接，只允许白名单内的地址
+type gateway struct {
+	rules          []*gatewayRule
+	connectTimeout int
+}
+
+// 允许连接的地址
+func (it *gateway) allowed(ip net.IP, port int) bool {
+	for _, rule := range it.rules {
+		if rule.allow(ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// 读取目标并连接，返回连接及目标地址，结果响应给请求方
+func (it *gateway) dial(relayConn net.Conn) (net.Conn, string, error) {
+	relayConn.SetDeadline(time.Now().Add(time.Duration(config.WaitTimeout) * time.Second))
+	defer relayConn.SetDeadline(time.Time{})
+
+	dialRequest := &core.DialRequest{}
+	if err := core.ReadJson2Object(relayConn, dialRequest); err != nil {
+		return nil, "", err
+	}
+	if dialRequest.Action != "dial" {
+		return nil, "", fmt.Errorf("unknow gateway action %s", dialRequest.Action)
+	}
+
+	conn, err := it.dialAllowed(dialRequest.Address)
+	if err != nil {
+		core.WriteObject2Json(relayConn, &core.Response{Message: err.Error()})
+		return nil, dialRequest.Address, err
+	}
+	if err := core.WriteObject2Json(relayConn, &core.Response{Message: "success"}); err != nil {
+		conn.Close()
+		return nil, dialRequest.Address, err
+	}
+	return conn, dialRequest.Address, nil
+}
+
+// 解析目标后只连接白名单内的IP（避免解析结果在检查后改变）
+func (it *gateway) dialAllowed(address string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %s", portText)
+	}
+
+	timeout := time.Duration(it.connectTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if it.allowed(addr.IP, port) {
+			return net.DialTimeout("tcp", net.JoinHostPort(addr.IP.String(), portText), timeout)
+		}
+	}
+	return nil, errors.New(core.DialNotAllowed)
+}
@@ -0,0 +1,91 @@
+package lan
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"tcp-tunnel/core"
+
+	"github.com/yymmiinngg/goargs"
+)
+
+// StartKeygen 生成LAN与CLIENT的256位加密密钥（--encrypt-key），可写入密钥文件
+func StartKeygen(argsArr []string) {
+
+	template := `
+    Usage: {{COMMAND}} KEYGEN {{OPTION}}
+
+	+ -f, --file  # Write the key to a new key file (mode 0600), and use it on the LAN
+	#               and CLIENT sides like "-e file:<path>"
+	? -s, --salt  # Also generate a random salt for the --encrypt-salt of a passphrase
+
+    ? -H, --help  # Show Help and Exit
+`
+
+	// 定义变量
+	var file string
+	var salt bool
+
+	// 编译模板
+	args, err := goargs.Compile(template)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	// 绑定变量
+	args.StringOption("-f", &file, "")
+	args.BoolOption("-s", &salt, false)
+
+	// 处理参数
+	err = args.Parse(argsArr, goargs.AllowUnknowOption)
+
+	// 显示帮助
+	if args.HasItem("-H", "--help") {
+		fmt.Println(args.Usage())
+		return
+	}
+
+	// 错误输出
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	key, err := core.GenerateEncryptKey()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	// 写入密钥文件，不覆盖已有的文件
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		_, err = f.WriteString(core.EncryptKeyHexPrefix + hex.EncodeToString(key) + "\n")
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		fmt.Println("key file:", core.EncryptKeyFilePrefix+file)
+	} else {
+		fmt.Println("hex key   :", core.EncryptKeyHexPrefix+hex.EncodeToString(key))
+		fmt.Println("base64 key:", core.EncryptKeyBase64Prefix+base64.StdEncoding.EncodeToString(key))
+	}
+
+	if salt {
+		saltBytes, err := core.RandBytes(16)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		fmt.Println("salt      :", base64.RawURLEncoding.EncodeToString(saltBytes))
+	}
+}
@@ -0,0 +1,155 @@
+package lan
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	nets "tcp-tunnel/net"
+	"time"
+)
+
+// WAN的地址，TCP（如 "1.1.1.1:3390"）、KCP（如 "kcp://1.1.1.1:3390"）或WebSocket（如 "wss://example.com/tcprp"）
+type serverAddress struct {
+	// TCP或KCP地址，经代理时由代理解析域名
+	address string
+	// WebSocket地址，为空时使用TCP
+	wsURL *url.URL
+	// KCP客户端，为空时使用TCP（不经代理）
+	kcp *nets.KcpClient
+	// 上次绑定时WAN返回的接管密钥，重连时带上
+	takeoverKey atomic.Pointer[string]
+}
+
+// 解析WAN地址，resolve时检查TCP地址可被解析
+func parseServerAddress(address string, resolve bool) (*serverAddress, error) {
+	address = strings.TrimSpace(address)
+	if nets.IsWebSocketURL(address) {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		return &serverAddress{wsURL: u}, nil
+	}
+	// KCP不经代理，总是检查地址
+	if nets.IsKcpAddress(address) {
+		address = strings.TrimPrefix(address, nets.KcpScheme)
+		if _, err := net.ResolveUDPAddr("udp", address); err != nil {
+			return nil, err
+		}
+		return &serverAddress{address: address, kcp: nets.NewKcpClient(address)}, nil
+	}
+	if resolve {
+		if _, err := net.ResolveTCPAddr("tcp", address); err != nil {
+			return nil, err
+		}
+	} else if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, err
+	}
+	return &serverAddress{address: address}, nil
+}
+
+// 上次绑定时的接管密钥，未绑定过时为空
+func (it *serverAddress) getTakeoverKey() string {
+	if takeoverKey := it.takeoverKey.Load(); takeoverKey != nil {
+		return *takeoverKey
+	}
+	return ""
+}
+
+func (it *serverAddress) String() string {
+	if it.wsURL != nil {
+		return it.wsURL.String()
+	}
+	if it.kcp != nil {
+		return nets.KcpScheme + it.address
+	}
+	return it.address
+}
+
+// 检测是否可连接，KCP无连接，以收到绑定握手的数据为准
+func (it *serverAddress) probe(dialer *nets.Dialer) error {
+	if it.kcp != nil {
+		conn, err := nets.NewKcpClient(it.address).DialBind()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(dialer.Timeout))
+		_, err = conn.Read(make([]byte, 1))
+		return err
+	}
+	address := it.address
+	if it.wsURL != nil {
+		address = it.wsURL.Host
+		if it.wsURL.Port() == "" && it.wsURL.Scheme == "wss" {
+			address = net.JoinHostPort(it.wsURL.Hostname(), "443")
+		} else if it.wsURL.Port() == "" {
+			address = net.JoinHostPort(it.wsURL.Hostname(), "80")
+		}
+	}
+	conn, err := dialer.Dial(address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// 连接绑定端口，WebSocket或KCP地址时useTls无效
+func (it *serverAddress) dialBind(dialer *nets.Dialer, useTls bool) (net.Conn, error) {
+	if it.wsURL != nil {
+		return nets.DialWebSocket(it.wsURL, dialer)
+	}
+	if it.kcp != nil {
+		return it.kcp.DialBind()
+	}
+	conn, err := dialer.Dial(it.address)
+	if err != nil {
+		return nil, err
+	}
+	if useTls {
+		host, _, _ := net.SplitHostPort(it.address)
+		return tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true}), nil
+	}
+	return conn, nil
+}
+
+// 连接转发端口，WebSocket地址时以参数relay指定转发端口，KCP时为会话上的流，
+// TCP时relayAddress（WAN公布的地址）不为空则连接此地址
+func (it *serverAddress) dialRelay(dialer *nets.Dialer, relayPort int, relayAddress string) (net.Conn, error) {
+	if it.wsURL != nil {
+		u := *it.wsURL
+		query := u.Query()
+		query.Set("relay", strconv.Itoa(relayPort))
+		u.RawQuery = query.Encode()
+		return nets.DialWebSocket(&u, dialer)
+	}
+	if it.kcp != nil {
+		return it.kcp.DialRelay(relayPort)
+	}
+	host, _, _ := net.SplitHostPort(it.address)
+	if relayAddress != "" {
+		advertiseHost, advertisePort, err := net.SplitHostPort(relayAddress)
+		if err != nil {
+			return nil, err
+		}
+		if advertiseHost != "" {
+			host = advertiseHost
+		}
+		return dialer.Dial(net.JoinHostPort(host, advertisePort))
+	}
+	return dialer.Dial(net.JoinHostPort(host, strconv.Itoa(relayPort)))
+}
+
+// 单端口模式下经绑定端口的转发连接，KCP时为当前会话上的流
+func (it *serverAddress) dialRelayBind(dialer *nets.Dialer, useTls bool) (net.Conn, error) {
+	if it.kcp != nil {
+		return it.kcp.DialRelay(0)
+	}
+	return it.dialBind(dialer, useTls)
+}
@@ -0,0 +1,52 @@
+package logger
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AccessRecord 一次转发会话的访问记录
+type AccessRecord struct {
+	Mode               string    `json:"mode"`
+	SessionID          string    `json:"sessionId"`
+	OpenPort           string    `json:"openPort,omitempty"`
+	ClientAddress      string    `json:"clientAddress,omitempty"`
+	LanAddress         string    `json:"lanAddress,omitempty"`
+	ApplicationAddress string    `json:"applicationAddress,omitempty"`
+	Destination        string    `json:"destination,omitempty"`
+	BytesFromClient    int64     `json:"bytesFromClient"`
+	BytesToClient      int64     `json:"bytesToClient"`
+	StartTime          time.Time `json:"startTime"`
+	EndTime            time.Time `json:"endTime"`
+	CloseReason        string    `json:"closeReason"`
+	Encrypted          bool      `json:"encrypted"`
+	// 协商的加密套件
+	Cipher string `json:"cipher,omitempty"`
+	// 压缩方式及压缩比（压缩前/压缩后）
+	Compression   string  `json:"compression,omitempty"`
+	CompressRatio float64 `json:"compressRatio,omitempty"`
+}
+
+// Access 输出访问记录（JSON行）
+func (it *Logger) Access(record *AccessRecord) {
+	record.Mode = it.mode
+	if it.handler != nil {
+		it.handler.Access(record)
+		return
+	}
+	if it.access == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		it.Error(err, "marshal access record error")
+		return
+	}
+	it.access.Out(&logEntry{
+		time:  time.Now().In(it.location),
+		mode:  it.mode,
+		level: LevelInfo,
+		msg:   string(data),
+		line:  string(data),
+	})
+}
@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// journald的原生协议套接字
+const journaldSocket = "/run/systemd/journal/socket"
+
+// 输出到journald：journald 或 journald:///path/to/socket
+// 字段：MESSAGE, PRIORITY, SYSLOG_IDENTIFIER, TCPRP_MODE 及 TCPRP_<KEY>
+type loggerOut2Journald struct {
+	conn *net.UnixConn
+	lock sync.Mutex
+}
+
+func openLoggerOut2Journald(out string) (*loggerOut2Journald, error) {
+	socket := strings.TrimPrefix(strings.TrimPrefix(out, "journald"), "://")
+	if socket == "" {
+		socket = journaldSocket
+	}
+	// 检查journald是否可用
+	if _, err := os.Stat(socket); err != nil {
+		return nil, fmt.Errorf("connect journald error: %s", err.Error())
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connect journald error: %s", err.Error())
+	}
+	return &loggerOut2Journald{conn: conn}, nil
+}
+
+func (it *loggerOut2Journald) Out(entry *logEntry) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	if _, err := it.conn.Write(it.format(entry)); err != nil {
+		// 无法输出时写到标准错误
+		fmt.Fprintln(os.Stderr, entry.line)
+	}
+}
+
+func (it *loggerOut2Journald) Close() {
+	it.conn.Close()
+}
+
+func (it *loggerOut2Journald) format(entry *logEntry) []byte {
+	buff := &bytes.Buffer{}
+	journaldField(buff, "MESSAGE", entry.message())
+	journaldField(buff, "PRIORITY", fmt.Sprint(syslogSeverity(entry.level)))
+	journaldField(buff, "SYSLOG_IDENTIFIER", "tcprp")
+	if entry.mode != "" {
+		journaldField(buff, "TCPRP_MODE", entry.mode)
+	}
+	for i := 0; i+1 < len(entry.fields); i += 2 {
+		journaldField(buff, "TCPRP_"+journaldFieldName(fmt.Sprint(entry.fields[i])), fmt.Sprint(entry.fields[i+1]))
+	}
+	return buff.Bytes()
+}
+
+// 写入一个字段，含换行的值使用长度前缀的二进制格式
+func journaldField(buff *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buff.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buff.WriteString(name + "\n")
+	binary.Write(buff, binary.LittleEndian, uint64(len(value)))
+	buff.WriteString(value + "\n")
+}
+
+// 字段名只能由大写字母、数字及下划线组成
+func journaldFieldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -1,79 +1,264 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 )
 
+// Level 日志级别
+type Level int
+
+const (
+	LevelTrace Level = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// 级别标签（文本格式中对齐为5个字符）
+var levelTags = []string{"TRACE", "DEBUG", "INFO ", "WARN ", "ERROR"}
+
+const (
+	// FormatText 文本格式
+	FormatText = "text"
+	// FormatJson JSON格式（每行一条）
+	FormatJson = "json"
+)
+
+// ParseLevel 解析日志级别名称
+func ParseLevel(name string) (Level, error) {
+	for i, tag := range levelTags {
+		if strings.EqualFold(strings.TrimSpace(tag), strings.TrimSpace(name)) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknow log level %s", name)
+}
+
+func (it Level) String() string {
+	return strings.ToLower(strings.TrimSpace(levelTags[it]))
+}
+
 type Logger struct {
-	mode  string
-	out   loggerOut
-	debug bool
+	mode     string
+	level    Level
+	format   string
+	location *time.Location
+	// 键值对字段
+	fields []interface{}
+	out    loggerOut
+	access loggerOut
+	// 外部的日志处理器（嵌入其他程序时使用）
+	handler Handler
+}
+
+// Handler 可替换的日志处理器，嵌入其他程序时用于接入其自身的日志系统
+type Handler interface {
+	// Log 输出一条日志，fields为键值对
+	Log(level Level, mode string, msg string, err error, fields []interface{})
+	// Access 输出一条访问记录
+	Access(record *AccessRecord)
 }
 
 type loggerOut interface {
-	Out(msg string)
+	Out(entry *logEntry)
 	Close()
 }
 
-func MakeLogger(mode, out string, debug bool) (*Logger, error) {
-	if out == "console" {
-		return &Logger{mode: mode, debug: debug, out: &loggerOut2Console{}}, nil
+// 一条日志
+type logEntry struct {
+	time   time.Time
+	mode   string
+	level  Level
+	msg    string
+	err    error
+	fields []interface{}
+	// 按格式输出的整行
+	line string
+}
+
+// 包含错误信息的消息
+func (it *logEntry) message() string {
+	if it.err != nil {
+		return it.msg + ": " + it.err.Error()
+	}
+	return it.msg
+}
+
+func MakeLogger(
+	mode string,
+	out string,
+	accessOut string,
+	level Level,
+	format string,
+	timezone string,
+	rotation *Rotation,
+) (*Logger, error) {
+
+	if format != FormatText && format != FormatJson {
+		return nil, fmt.Errorf("unknow log format %s", format)
 	}
-	file, err := os.OpenFile(out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	// 时区只加载一次
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("load log timezone error: %s", err.Error())
+	}
+
+	logOut, err := makeLoggerOut(out, rotation, location)
 	if err != nil {
 		return nil, err
 	}
-	return &Logger{mode: mode, debug: debug, out: &loggerOut2File{file: file}}, nil
+	// 访问日志（未指定则不输出）
+	var accessLogOut loggerOut
+	if accessOut != "" {
+		accessLogOut, err = makeLoggerOut(accessOut, rotation, location)
+		if err != nil {
+			logOut.Close()
+			return nil, err
+		}
+	}
+	return &Logger{
+		mode:     mode,
+		level:    level,
+		format:   format,
+		location: location,
+		out:      logOut,
+		access:   accessLogOut,
+	}, nil
+}
+
+// NewLogger 创建使用外部处理器的日志对象，handler为空时不输出任何日志
+func NewLogger(mode string, level Level, handler Handler) *Logger {
+	return &Logger{
+		mode:     mode,
+		level:    level,
+		format:   FormatText,
+		location: time.Local,
+		handler:  handler,
+	}
+}
+
+func makeLoggerOut(out string, rotation *Rotation, location *time.Location) (loggerOut, error) {
+	if out == "console" {
+		return &loggerOut2Console{}, nil
+	}
+	if out == "journald" || strings.HasPrefix(out, "journald://") {
+		return openLoggerOut2Journald(out)
+	}
+	if strings.HasPrefix(out, "syslog://") || strings.HasPrefix(out, "syslog+udp://") || strings.HasPrefix(out, "syslog+tcp://") {
+		return openLoggerOut2Syslog(out)
+	}
+	return openLoggerOut2File(out, rotation, location)
 }
 
 type loggerOut2Console struct{}
 
-func (it *loggerOut2Console) Out(msg string) {
-	fmt.Println(msg)
+func (it *loggerOut2Console) Out(entry *logEntry) {
+	fmt.Println(entry.line)
 }
 
 func (it *loggerOut2Console) Close() {
 }
 
-type loggerOut2File struct {
-	file *os.File
+// With 返回附带键值对字段的日志对象，如 log.With("binding", ":80")
+func (it *Logger) With(kv ...interface{}) *Logger {
+	logger := *it
+	logger.fields = append(append([]interface{}{}, it.fields...), kv...)
+	return &logger
 }
 
-func (it *loggerOut2File) Close() {
-	it.file.Close()
+// Enabled 是否输出该级别的日志
+func (it *Logger) Enabled(level Level) bool {
+	return level >= it.level
 }
 
-func (it *loggerOut2File) Out(msg string) {
-	it.file.WriteString(msg + "\n")
+func (it *Logger) Trace(message ...string) {
+	it.log(LevelTrace, nil, message)
 }
 
-func (it *Logger) tag(tag string) string {
-	loc, _ := time.LoadLocation("Asia/Shanghai")
-	t := time.Now().In(loc)
-	return fmt.Sprintf("[%s] [%s] [%s]", t.Format("2006-01-02 15:04:05"), it.mode, tag)
+func (it *Logger) Debug(message ...string) {
+	it.log(LevelDebug, nil, message)
 }
 
 func (it *Logger) Info(message ...string) {
-	it.output(it.tag("INFO "), strings.Join(message, " "))
+	it.log(LevelInfo, nil, message)
+}
+
+func (it *Logger) Warn(message ...string) {
+	it.log(LevelWarn, nil, message)
 }
 
 func (it *Logger) Error(err error, message ...string) {
-	it.output(it.tag("ERROR"), strings.Join(message, " ")+":", err.Error())
+	it.log(LevelError, err, message)
 }
 
-func (it *Logger) Debug(message ...string) {
-	if it.debug {
-		it.output(it.tag("DEBUG"), strings.Join(message, " "))
+func (it *Logger) log(level Level, err error, message []string) {
+	if !it.Enabled(level) {
+		return
+	}
+	if it.out == nil {
+		if it.handler != nil {
+			it.handler.Log(level, it.mode, strings.Join(message, " "), err, it.fields)
+		}
+		return
 	}
+	entry := &logEntry{
+		time:   time.Now().In(it.location),
+		mode:   it.mode,
+		level:  level,
+		msg:    strings.Join(message, " "),
+		err:    err,
+		fields: it.fields,
+	}
+	if it.format == FormatJson {
+		entry.line = it.jsonLine(entry.time, level, err, entry.msg)
+	} else {
+		entry.line = it.textLine(entry.time, level, err, entry.msg)
+	}
+	it.out.Out(entry)
 }
 
-func (it *Logger) output(msg ...string) {
-	it.out.Out(strings.Join(msg, " "))
+// [2006-01-02 15:04:05] [WAN] [INFO ] message key=value
+func (it *Logger) textLine(t time.Time, level Level, err error, msg string) string {
+	line := fmt.Sprintf("[%s] [%s] [%s] %s", t.Format("2006-01-02 15:04:05"), it.mode, levelTags[level], msg)
+	if err != nil {
+		line += ": " + err.Error()
+	}
+	for i := 0; i+1 < len(it.fields); i += 2 {
+		line += fmt.Sprintf(" %v=%v", it.fields[i], it.fields[i+1])
+	}
+	return line
+}
+
+// {"time":"...","mode":"WAN","level":"info","msg":"message","key":"value"}
+func (it *Logger) jsonLine(t time.Time, level Level, err error, msg string) string {
+	data := make(map[string]interface{}, 5+len(it.fields)/2)
+	for i := 0; i+1 < len(it.fields); i += 2 {
+		data[fmt.Sprint(it.fields[i])] = it.fields[i+1]
+	}
+	data["time"] = t.Format(time.RFC3339Nano)
+	data["mode"] = it.mode
+	data["level"] = level.String()
+	data["msg"] = msg
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	line, jsonErr := json.Marshal(data)
+	if jsonErr != nil {
+		return it.textLine(t, level, err, msg)
+	}
+	return string(line)
 }
 
 func (it *Logger) Close() {
-	it.out.Close()
+	if it.out != nil {
+		it.out.Close()
+	}
+	if it.access != nil {
+		it.access.Close()
+	}
 }
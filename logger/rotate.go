@@ -0,0 +1,199 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RotateNone 不按时间切割
+	RotateNone = "none"
+	// RotateHourly 每小时切割
+	RotateHourly = "hourly"
+	// RotateDaily 每天切割
+	RotateDaily = "daily"
+)
+
+// Rotation 日志文件的切割及保留设置
+type Rotation struct {
+	// 单个文件的最大字节数，0为不限
+	MaxSize int64
+	// 按时间切割：none, hourly, daily
+	Interval string
+	// 保留的历史文件数，0为不限
+	MaxBackups int
+	// 历史文件的保留天数，0为不限
+	MaxAge int
+}
+
+// 所有打开的日志文件，收到重新打开的信号时使用
+var openedFiles = make(map[*loggerOut2File]bool)
+var openedFilesLock sync.Mutex
+var watchReopenOnce sync.Once
+
+// Reopen 重新打开所有日志文件（用于外部的日志切割工具）
+func Reopen() {
+	openedFilesLock.Lock()
+	defer openedFilesLock.Unlock()
+	for out := range openedFiles {
+		out.reopen()
+	}
+}
+
+type loggerOut2File struct {
+	path string
+	// 打开失败时为空，输出到标准错误并在下次输出时重试
+	file     *os.File
+	rotation *Rotation
+	location *time.Location
+	// 当前文件的大小及时间段
+	size   int64
+	period string
+	lock   sync.Mutex
+}
+
+func openLoggerOut2File(path string, rotation *Rotation, location *time.Location) (*loggerOut2File, error) {
+	if rotation == nil {
+		rotation = &Rotation{}
+	}
+	it := &loggerOut2File{
+		path:     path,
+		rotation: rotation,
+		location: location,
+	}
+	if err := it.open(); err != nil {
+		return nil, err
+	}
+
+	openedFilesLock.Lock()
+	openedFiles[it] = true
+	openedFilesLock.Unlock()
+	watchReopenOnce.Do(watchReopenSignal)
+	return it, nil
+}
+
+func (it *loggerOut2File) open() error {
+	file, err := os.OpenFile(it.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	it.file = file
+	it.size = info.Size()
+	it.period = it.currentPeriod(info.ModTime())
+	return nil
+}
+
+func (it *loggerOut2File) Close() {
+	openedFilesLock.Lock()
+	delete(openedFiles, it)
+	openedFilesLock.Unlock()
+
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	it.closeFile()
+}
+
+func (it *loggerOut2File) Out(entry *logEntry) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+
+	// 之前打开失败，重试，仍失败时输出到标准错误，避免丢失日志
+	if it.file == nil && it.open() != nil {
+		os.Stderr.WriteString(entry.line + "\n")
+		return
+	}
+	// 按大小或时间切割
+	if (it.rotation.MaxSize > 0 && it.size+int64(len(entry.line))+1 > it.rotation.MaxSize && it.size > 0) ||
+		it.currentPeriod(time.Now()) != it.period {
+		it.rotate()
+	}
+	if it.file == nil {
+		os.Stderr.WriteString(entry.line + "\n")
+		return
+	}
+	size, _ := it.file.WriteString(entry.line + "\n")
+	it.size += int64(size)
+}
+
+// 关闭当前文件（打开失败时没有文件，不能关闭标准错误）
+func (it *loggerOut2File) closeFile() {
+	if it.file != nil {
+		it.file.Close()
+		it.file = nil
+	}
+}
+
+// 重新打开文件
+func (it *loggerOut2File) reopen() {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	it.closeFile()
+	// 打开失败时在下次输出时重试
+	it.open()
+}
+
+// 当前的时间段
+func (it *loggerOut2File) currentPeriod(t time.Time) string {
+	switch it.rotation.Interval {
+	case RotateHourly:
+		return t.In(it.location).Format("2006010215")
+	case RotateDaily:
+		return t.In(it.location).Format("20060102")
+	}
+	return ""
+}
+
+// 切割当前文件并清理历史文件
+func (it *loggerOut2File) rotate() {
+	it.closeFile()
+	backup := it.path + "." + time.Now().In(it.location).Format("20060102-150405.000")
+	os.Rename(it.path, backup)
+	// 打开失败时在下次输出时重试
+	it.open()
+	it.cleanBackups()
+}
+
+// 按数量及天数清理历史文件
+func (it *loggerOut2File) cleanBackups() {
+	if it.rotation.MaxBackups <= 0 && it.rotation.MaxAge <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(it.path + ".*")
+	if err != nil {
+		return
+	}
+	// 历史文件名以时间结尾，倒序后靠前的为最新
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	count := 0
+	for _, backup := range backups {
+		if !isBackupName(strings.TrimPrefix(backup, it.path+".")) {
+			continue
+		}
+		count++
+		if it.rotation.MaxBackups > 0 && count > it.rotation.MaxBackups {
+			os.Remove(backup)
+			continue
+		}
+		if it.rotation.MaxAge > 0 {
+			info, err := os.Stat(backup)
+			if err == nil && time.Since(info.ModTime()) > time.Duration(it.rotation.MaxAge)*24*time.Hour {
+				os.Remove(backup)
+			}
+		}
+	}
+}
+
+// 是否为历史文件的后缀（20060102-150405.000）
+func isBackupName(suffix string) bool {
+	_, err := time.Parse("20060102-150405.000", suffix)
+	return err == nil
+}
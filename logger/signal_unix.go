@@ -0,0 +1,20 @@
+//go:build !windows
+
+package logger
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// 收到SIGUSR1时重新打开日志文件
+func watchReopenSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			Reopen()
+		}
+	}()
+}
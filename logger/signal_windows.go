@@ -0,0 +1,7 @@
+//go:build windows
+
+package logger
+
+// Windows没有SIGUSR1，可调用Reopen重新打开日志文件
+func watchReopenSignal() {
+}
@@ -0,0 +1,204 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 本地syslog的unix套接字
+var syslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslog设施
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// 结构化数据的ID（32473为文档示例用的企业编号）
+const syslogSdID = "tcprp@32473"
+
+// 时间戳格式，RFC5424的秒的小数最多6位
+const syslogTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+// 输出到syslog（RFC5424格式）：
+//   - syslog://                本地套接字（/dev/log 等）
+//   - syslog:///path/to/socket 指定的本地套接字
+//   - syslog+udp://host:514    远程UDP
+//   - syslog+tcp://host:514    远程TCP（RFC6587 按长度分帧）
+//
+// 可用参数 ?facility=local0&tag=tcprp
+type loggerOut2Syslog struct {
+	network  string
+	address  string
+	facility int
+	tag      string
+	hostname string
+	conn     net.Conn
+	lock     sync.Mutex
+}
+
+func openLoggerOut2Syslog(out string) (*loggerOut2Syslog, error) {
+	u, err := url.Parse(out)
+	if err != nil {
+		return nil, fmt.Errorf("parse syslog address error: %s", err.Error())
+	}
+
+	it := &loggerOut2Syslog{
+		facility: syslogFacilities["daemon"],
+		tag:      "tcprp",
+	}
+	if facility := u.Query().Get("facility"); facility != "" {
+		value, ok := syslogFacilities[strings.ToLower(facility)]
+		if !ok {
+			return nil, fmt.Errorf("unknow syslog facility %s", facility)
+		}
+		it.facility = value
+	}
+	if tag := u.Query().Get("tag"); tag != "" {
+		it.tag = tag
+	}
+	it.hostname, _ = os.Hostname()
+	if it.hostname == "" {
+		it.hostname = "-"
+	}
+
+	switch u.Scheme {
+	case "syslog":
+		// 远程主机须指定协议，避免写到本地套接字
+		if u.Host != "" {
+			return nil, fmt.Errorf("use syslog+udp:// or syslog+tcp:// for the remote syslog %s", out)
+		}
+		it.network = "unixgram"
+		it.address = u.Path
+	case "syslog+udp":
+		it.network = "udp"
+		it.address = u.Host
+	case "syslog+tcp":
+		it.network = "tcp"
+		it.address = u.Host
+	}
+	if it.network != "unixgram" && it.address == "" {
+		return nil, fmt.Errorf("missing syslog host in %s", out)
+	}
+
+	if err := it.connect(); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (it *loggerOut2Syslog) connect() error {
+	// 未指定本地套接字时逐个尝试
+	if it.network == "unixgram" && it.address == "" {
+		var err error
+		for _, socket := range syslogSockets {
+			it.conn, err = net.Dial("unixgram", socket)
+			if err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("connect local syslog error: %s", err.Error())
+	}
+	conn, err := net.DialTimeout(it.network, it.address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("connect syslog error: %s", err.Error())
+	}
+	it.conn = conn
+	return nil
+}
+
+func (it *loggerOut2Syslog) Out(entry *logEntry) {
+	msg := it.format(entry)
+	if it.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	// 写入失败时重连一次
+	for i := 0; i < 2; i++ {
+		if it.conn == nil {
+			if err := it.connect(); err != nil {
+				break
+			}
+		}
+		if _, err := it.conn.Write([]byte(msg)); err == nil {
+			return
+		}
+		it.conn.Close()
+		it.conn = nil
+	}
+	// 无法输出时写到标准错误
+	fmt.Fprintln(os.Stderr, entry.line)
+}
+
+func (it *loggerOut2Syslog) Close() {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	if it.conn != nil {
+		it.conn.Close()
+		it.conn = nil
+	}
+}
+
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID key="value"...] MSG
+func (it *loggerOut2Syslog) format(entry *logEntry) string {
+	pri := it.facility*8 + syslogSeverity(entry.level)
+	sd := "[" + syslogSdID + ` mode="` + syslogSdEscape(entry.mode) + `"`
+	for i := 0; i+1 < len(entry.fields); i += 2 {
+		sd += " " + syslogSdName(fmt.Sprint(entry.fields[i])) + `="` + syslogSdEscape(fmt.Sprint(entry.fields[i+1])) + `"`
+	}
+	sd += "]"
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		pri,
+		entry.time.Format(syslogTimeLayout),
+		it.hostname,
+		it.tag,
+		os.Getpid(),
+		syslogMsgID(entry.mode),
+		sd,
+		entry.message(),
+	)
+}
+
+// 日志级别对应的syslog严重程度
+func syslogSeverity(level Level) int {
+	switch level {
+	case LevelError:
+		return 3
+	case LevelWarn:
+		return 4
+	case LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+func syslogMsgID(mode string) string {
+	if mode == "" {
+		return "-"
+	}
+	return mode
+}
+
+// 参数名只能是可打印字符，且不能包含 = ] " 及空格
+func syslogSdName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// 参数值需转义 " \ ]
+func syslogSdEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -37,12 +37,15 @@ func main() {
 	template := `
 	Usage: {{COMMAND}} <MODE> [SCRIPT-FILE] {{OPTION}}
 	
-	# MODE: { LAN, WAN, CLIENT, SCRIPT }
+	# MODE: { LAN, WAN, CLIENT, SCRIPT, BAN, TOKEN, KEYGEN }
 	
 	#   LAN     Run a LAN program to forward traffic from WAN to the application port
 	#   WAN     Run a WAN program to forward traffic from user clients to LAN client
 	#   CLIENT  Run a CLIENT program to forward traffic from user clients to WAN client
 	#   SCRIPT  Load a script file to run multiple LAN, WAN or CLIENT side programs.
+	#   BAN     List or unban the IPs banned by a WAN program (--ban-file)
+	#   TOKEN   Sign or inspect the bind tokens of LAN, or generate a token key pair
+	#   KEYGEN  Generate a strong encrypt key for the LAN and CLIENT (--encrypt-key)
 
 	# SCRIPT-FILE:
 	
@@ -53,20 +56,45 @@ func main() {
 	#   LAN -a 10.0.0.1:8081 -s 100.100.100.1:9981 -o :8081 
 	#   LAN -a 10.0.0.1:8082 -s 100.100.100.1:9982 -o :8082
 	
-	?  -D, --debug    # Output debug message, There are a lot of logs in debug mode
-	+  -L, --logger   # Output log to:
-	#                    - console: Out to console (Default)
-	#                    - User specified file, like: /var/log/tcprp-out.log
-
-    ?  -H, --help     # Show Help and Exit
-    ?  -V, --version  # Show Version and Exit
+	?  -D, --debug            # Output debug message, There are a lot of logs in debug mode,
+	#                           the same as --log-level=debug
+	+  -L, --logger           # Output log to:
+	#                           - console: Out to console (Default)
+	#                           - User specified file, like: /var/log/tcprp-out.log
+	#                           - syslog://: Local syslog, or syslog:///path/to/socket
+	#                           - syslog+udp://host:514, syslog+tcp://host:514:
+	#                             Remote syslog (RFC5424), options: ?facility=local0&tag=tcprp
+	#                           - journald: Local systemd journal
+	+  -A, --access-log       # Output access log (one JSON line per relayed session) to:
+	#                           - console: Out to console
+	#                           - User specified file, like: /var/log/tcprp-access.log
+	#                           - syslog or journald, the same as -L
+	#                           Disabled by default
+	+      --log-level        # Output the logs at or above the level: trace, debug, info,
+	#                           warn or error (Default: info)
+	+      --log-format       # Log line format: text or json (Default: text)
+	+      --log-timezone     # Timezone of the log time, like "UTC" or "Local"
+	#                           (Default: Asia/Shanghai)
+	+      --log-max-size     # Rotate the log file when it reaches the size (Unit: MB,
+	#                           Default: 0, no limit)
+	+      --log-rotate       # Rotate the log file by time: none, hourly or daily
+	#                           (Default: none)
+	+      --log-max-backups  # Count of rotated log files to keep (Default: 0, keep all)
+	+      --log-max-age      # Days to keep rotated log files (Default: 0, keep all)
+	#                           Send SIGUSR1 to reopen the log files after moving them
+
+    ?  -H, --help        # Show Help and Exit
+    ?  -V, --version     # Show Version and Exit
 	`
 
 	// 定义变量
 	var mode_ string
 	var script_ string
 	var logger_ string
+	var accessLog string
 	var debug bool
+	var logLevel, logFormat, logTimezone, logRotate string
+	var logMaxSize, logMaxBackups, logMaxAge int
 
 	// 编译模板
 	args, err := goargs.Compile(template)
@@ -78,7 +106,15 @@ func main() {
 	args.StringOperan("MODE", &mode_, "")
 	args.StringOperan("SCRIPT-FILE", &script_, "")
 	args.StringOption("-L", &logger_, "console")
+	args.StringOption("-A", &accessLog, "")
 	args.BoolOption("-D", &debug, false)
+	args.StringOption("--log-level", &logLevel, "")
+	args.StringOption("--log-format", &logFormat, logger.FormatText)
+	args.StringOption("--log-timezone", &logTimezone, "Asia/Shanghai")
+	args.IntOption("--log-max-size", &logMaxSize, 0)
+	args.StringOption("--log-rotate", &logRotate, logger.RotateNone)
+	args.IntOption("--log-max-backups", &logMaxBackups, 0)
+	args.IntOption("--log-max-age", &logMaxAge, 0)
 
 	// 处理参数
 	err = args.Parse(argsArr, goargs.AllowUnknowOption)
@@ -93,7 +129,7 @@ func main() {
 	}
 
 	// 显示帮助
-	if args.HasItem("-H", "--help") && (mode_ == "" || !strings.Contains(" LAN | WAN | CLIENT | SCRIPT ", strings.ToUpper(mode_))) {
+	if args.HasItem("-H", "--help") && (mode_ == "" || !strings.Contains(" LAN | WAN | CLIENT | SCRIPT | BAN | TOKEN | KEYGEN ", strings.ToUpper(mode_))) {
 		fmt.Println(args.Usage())
 		return
 	}
@@ -104,8 +140,31 @@ func main() {
 		return
 	}
 
+	// 日志级别，未指定时由调试开关决定
+	if logLevel == "" {
+		logLevel = "info"
+		if debug {
+			logLevel = "debug"
+		}
+	}
+	level, err := logger.ParseLevel(logLevel)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if logRotate != logger.RotateNone && logRotate != logger.RotateHourly && logRotate != logger.RotateDaily {
+		fmt.Println("Unknow log rotate", logRotate)
+		return
+	}
+
 	// 创建日志对象
-	log, err := logger.MakeLogger(mode_, logger_, debug)
+	log, err := logger.MakeLogger(mode_, logger_, accessLog, level, logFormat, logTimezone, &logger.Rotation{
+		MaxSize:    int64(logMaxSize) * 1024 * 1024,
+		Interval:   logRotate,
+		MaxBackups: logMaxBackups,
+		MaxAge:     logMaxAge,
+	})
 	if err != nil {
 		fmt.Println(err.Error())
 		return
@@ -119,6 +178,12 @@ func main() {
 			wan.Start(argsarr, log)
 		} else if strings.ToLower(mode) == "client" {
 			client.Start(argsarr, log)
+		} else if strings.ToLower(mode) == "ban" {
+			wan.StartBan(argsarr)
+		} else if strings.ToLower(mode) == "token" {
+			wan.StartToken(argsarr)
+		} else if strings.ToLower(mode) == "keygen" {
+			lan.StartKeygen(argsarr)
 		} else if strings.ToLower(mode) == "script" {
 			fmt.Printf("Can't run script mode in script file\n")
 			os.Exit(1)
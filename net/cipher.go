@@ -0,0 +1,61 @@
+package nets
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"tcp-tunnel/core"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// 没有双方都支持的加密套件时CLIENT的响应消息
+const noCommonCipherSuite = "no common cipher suite"
+
+// OfferCipherSuite LAN经转发握手后的控制连接提供加密套件，返回CLIENT选择的套件
+func OfferCipherSuite(conn net.Conn, suites []string, ioTimeout int) (string, error) {
+	if ioTimeout > 0 {
+		defer conn.SetDeadline(time.Time{})
+		conn.SetDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
+	}
+	if err := core.WriteObject2Json(conn, &core.CipherRequest{
+		Reqeust: core.Reqeust{Action: "cipher"},
+		Suites:  suites,
+	}); err != nil {
+		return "", err
+	}
+	response := &core.Response{}
+	if err := core.ReadJson2Object(conn, response); err != nil {
+		return "", err
+	}
+	if response.Message == noCommonCipherSuite {
+		return "", errors.New(noCommonCipherSuite)
+	}
+	if !slices.Contains(suites, response.Message) {
+		return "", fmt.Errorf("cipher suite %s not offered", response.Message)
+	}
+	return response.Message, nil
+}
+
+// AcceptCipherSuite CLIENT读取LAN提供的加密套件，按suites的顺序选择第一个双方都支持的套件
+func AcceptCipherSuite(conn net.Conn, suites []string, ioTimeout int) (string, error) {
+	if ioTimeout > 0 {
+		defer conn.SetDeadline(time.Time{})
+		conn.SetDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
+	}
+	request := &core.CipherRequest{}
+	if err := core.ReadJson2Object(conn, request); err != nil {
+		return "", err
+	}
+	if request.Action != "cipher" {
+		return "", fmt.Errorf("unknow relay action %s", request.Action)
+	}
+	for _, preferred := range suites {
+		if slices.Contains(request.Suites, preferred) {
+			return preferred, core.WriteObject2Json(conn, &core.Response{Message: preferred})
+		}
+	}
+	core.WriteObject2Json(conn, &core.Response{Message: noCommonCipherSuite})
+	return "", fmt.Errorf("%s, the LAN offers %v", noCommonCipherSuite, request.Suites)
+}
@@ -0,0 +1,36 @@
+package nets
+
+import (
+	"net"
+	"tcp-tunnel/core"
+	"testing"
+)
+
+func TestNegotiateCipherSuite(t *testing.T) {
+	lan, lanErr, client, clientErr := negotiate(
+		func(conn net.Conn) (string, error) {
+			return OfferCipherSuite(conn, []string{core.CipherAes256Gcm, core.CipherChaCha20Poly1305}, 5)
+		},
+		func(conn net.Conn) (string, error) {
+			return AcceptCipherSuite(conn, []string{core.CipherChaCha20Poly1305, core.CipherAes256Gcm}, 5)
+		},
+	)
+	if lanErr != nil || clientErr != nil {
+		t.Fatalf("negotiate error: %v, %v", lanErr, clientErr)
+	}
+	if lan != core.CipherChaCha20Poly1305 || client != core.CipherChaCha20Poly1305 {
+		t.Fatalf("negotiated %s and %s, expected %s", lan, client, core.CipherChaCha20Poly1305)
+	}
+
+	_, lanErr, _, clientErr = negotiate(
+		func(conn net.Conn) (string, error) {
+			return OfferCipherSuite(conn, []string{core.CipherAes256Gcm}, 5)
+		},
+		func(conn net.Conn) (string, error) {
+			return AcceptCipherSuite(conn, []string{core.CipherNone}, 5)
+		},
+	)
+	if lanErr == nil || clientErr == nil {
+		t.Fatal("no common cipher suite should fail on both sides")
+	}
+}
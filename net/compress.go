@@ -0,0 +1,64 @@
+package nets
+
+import (
+	"fmt"
+	"net"
+	"tcp-tunnel/core"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// OfferCompression LAN提供可用的压缩方式，返回CLIENT选择的压缩处理器（不压缩时为空）
+func OfferCompression(conn net.Conn, methods []string, ioTimeout int) (core.Compressor, error) {
+	if ioTimeout > 0 {
+		defer conn.SetDeadline(time.Time{})
+		conn.SetDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
+	}
+	if err := core.WriteObject2Json(conn, &core.CompressRequest{
+		Reqeust: core.Reqeust{Action: "compress"},
+		Methods: methods,
+	}); err != nil {
+		return nil, err
+	}
+	response := &core.Response{}
+	if err := core.ReadJson2Object(conn, response); err != nil {
+		return nil, err
+	}
+	if response.Message == core.CompressNone {
+		return nil, nil
+	}
+	if !slices.Contains(methods, response.Message) {
+		return nil, fmt.Errorf("compression %s not offered", response.Message)
+	}
+	return core.NewCompressor(response.Message)
+}
+
+// AcceptCompression CLIENT读取LAN提供的压缩方式，按methods的顺序选择第一个双方都支持的方式
+func AcceptCompression(conn net.Conn, methods []string, ioTimeout int) (core.Compressor, error) {
+	if ioTimeout > 0 {
+		defer conn.SetDeadline(time.Time{})
+		conn.SetDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
+	}
+	request := &core.CompressRequest{}
+	if err := core.ReadJson2Object(conn, request); err != nil {
+		return nil, err
+	}
+	if request.Action != "compress" {
+		return nil, fmt.Errorf("unknow relay action %s", request.Action)
+	}
+	method := core.CompressNone
+	for _, preferred := range methods {
+		if slices.Contains(request.Methods, preferred) {
+			method = preferred
+			break
+		}
+	}
+	if err := core.WriteObject2Json(conn, &core.Response{Message: method}); err != nil {
+		return nil, err
+	}
+	if method == core.CompressNone {
+		return nil, nil
+	}
+	return core.NewCompressor(method)
+}
@@ -0,0 +1,69 @@
+package nets
+
+import (
+	"net"
+	"tcp-tunnel/core"
+	"testing"
+)
+
+// 在内存连接上协商，返回LAN及CLIENT的结果
+func negotiate[T any](offer func(conn net.Conn) (T, error), accept func(conn net.Conn) (T, error)) (T, error, T, error) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	type result struct {
+		value T
+		err   error
+	}
+	offered := make(chan result, 1)
+	go func() {
+		value, err := offer(a)
+		a.Close()
+		offered <- result{value, err}
+	}()
+	accepted, acceptErr := accept(b)
+	b.Close()
+	lan := <-offered
+	return lan.value, lan.err, accepted, acceptErr
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	lan, lanErr, client, clientErr := negotiate(
+		func(conn net.Conn) (core.Compressor, error) {
+			return OfferCompression(conn, []string{core.CompressZstd, core.CompressSnappy}, 5)
+		},
+		func(conn net.Conn) (core.Compressor, error) {
+			return AcceptCompression(conn, []string{core.CompressSnappy, core.CompressZstd}, 5)
+		},
+	)
+	if lanErr != nil || clientErr != nil {
+		t.Fatalf("negotiate error: %v, %v", lanErr, clientErr)
+	}
+	defer lan.Close()
+	defer client.Close()
+	// 按CLIENT的优先顺序
+	if lan.Name() != core.CompressSnappy || client.Name() != core.CompressSnappy {
+		t.Fatalf("negotiated %s and %s, expected snappy", lan.Name(), client.Name())
+	}
+	data, err := client.Decompress(lan.Compress([]byte("hello hello hello")))
+	if err != nil || string(data) != "hello hello hello" {
+		t.Fatalf("compressed relay: %q, %v", data, err)
+	}
+}
+
+func TestNegotiateNoCompression(t *testing.T) {
+	lan, lanErr, client, clientErr := negotiate(
+		func(conn net.Conn) (core.Compressor, error) {
+			return OfferCompression(conn, []string{core.CompressZstd}, 5)
+		},
+		func(conn net.Conn) (core.Compressor, error) {
+			return AcceptCompression(conn, []string{core.CompressSnappy}, 5)
+		},
+	)
+	if lanErr != nil || clientErr != nil {
+		t.Fatalf("negotiate error: %v, %v", lanErr, clientErr)
+	}
+	if lan != nil || client != nil {
+		t.Fatal("no common compression should not compress")
+	}
+}
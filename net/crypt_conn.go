@@ -0,0 +1,49 @@
+package nets
+
+import (
+	"net"
+	"tcp-tunnel/core"
+)
+
+// 读时解密、写时加密的连接，与Relay共用同一个加解密处理器以保持流（帧序号）的位置
+type cryptConn struct {
+	net.Conn
+	cryptor core.Cryptor
+	// 已解密未读取的数据
+	pending []byte
+}
+
+// NewCryptConn 包装连接，cryptor为空时原样返回
+func NewCryptConn(conn net.Conn, cryptor core.Cryptor) net.Conn {
+	if cryptor == nil {
+		return conn
+	}
+	return &cryptConn{Conn: conn, cryptor: cryptor}
+}
+
+// 每次最多从连接读取len(b)字节，避免读入之后转发的数据
+func (it *cryptConn) Read(b []byte) (int, error) {
+	for len(it.pending) == 0 {
+		size, err := it.Conn.Read(b)
+		if size > 0 {
+			data, decryptErr := it.cryptor.Decrypt(b[:size])
+			if decryptErr != nil {
+				return 0, decryptErr
+			}
+			it.pending = data
+		}
+		if err != nil && len(it.pending) == 0 {
+			return 0, err
+		}
+	}
+	size := copy(b, it.pending)
+	it.pending = it.pending[size:]
+	return size, nil
+}
+
+func (it *cryptConn) Write(b []byte) (int, error) {
+	if _, err := it.Conn.Write(it.cryptor.Encrypt(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
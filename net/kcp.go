@@ -0,0 +1,229 @@
+package nets
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"tcp-tunnel/core"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+)
+
+// KcpScheme KCP地址的前缀，如 "kcp://1.1.1.1:3390"
+const KcpScheme = "kcp://"
+
+// IsKcpAddress 是否为KCP地址
+func IsKcpAddress(address string) bool {
+	return strings.HasPrefix(address, KcpScheme)
+}
+
+// IsKcpStream 是否为KCP会话上的流
+func IsKcpStream(conn net.Conn) bool {
+	_, ok := conn.(*smux.Stream)
+	return ok
+}
+
+// 适合丢包链路的参数（快速重传、关闭拥塞控制）
+func tuneKcp(session *kcp.UDPSession) {
+	session.SetStreamMode(true)
+	session.SetWriteDelay(false)
+	session.SetNoDelay(1, 20, 2, 1)
+	session.SetWindowSize(1024, 1024)
+	session.SetACKNoDelay(true)
+}
+
+func smuxConfig() *smux.Config {
+	config := smux.DefaultConfig()
+	config.KeepAliveInterval = 10 * time.Second
+	config.KeepAliveTimeout = 30 * time.Second
+	return config
+}
+
+// 每个流的前两个字节为转发流的标识（WAN在绑定时分配），0为绑定连接
+func writeStreamID(conn net.Conn, streamID int) error {
+	buff := make([]byte, 2)
+	binary.BigEndian.PutUint16(buff, uint16(streamID))
+	_, err := conn.Write(buff)
+	return err
+}
+
+// ReadStreamID 读取流的标识，0为绑定连接
+func ReadStreamID(conn net.Conn, timeout time.Duration) (int, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buff := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buff); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(buff)), nil
+}
+
+// KcpListener 接受KCP会话，Accept返回各会话上的流
+type KcpListener struct {
+	listener *kcp.Listener
+	streams  chan net.Conn
+	done     chan struct{}
+	err      error
+	errOnce  sync.Once
+}
+
+// ListenKcp 监听UDP端口
+func ListenKcp(address string) (*KcpListener, error) {
+	listener, err := kcp.ListenWithOptions(address, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	it := &KcpListener{
+		listener: listener,
+		streams:  make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go it.acceptSessions()
+	return it, nil
+}
+
+func (it *KcpListener) acceptSessions() {
+	for {
+		conn, err := it.listener.AcceptKCP()
+		if err != nil {
+			it.fail(err)
+			return
+		}
+		tuneKcp(conn)
+		session, err := smux.Server(conn, smuxConfig())
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		go it.acceptStreams(session)
+	}
+}
+
+func (it *KcpListener) acceptStreams(session *smux.Session) {
+	defer session.Close()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		select {
+		case it.streams <- stream:
+		case <-it.done:
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (it *KcpListener) fail(err error) {
+	it.errOnce.Do(func() {
+		it.err = err
+		close(it.done)
+	})
+}
+
+// Accept 返回下一个流，流的开头为流的标识（见ReadStreamID）
+func (it *KcpListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-it.streams:
+		return stream, nil
+	case <-it.done:
+		return nil, it.err
+	}
+}
+
+func (it *KcpListener) Close() error {
+	it.fail(core.ErrClosed)
+	return it.listener.Close()
+}
+
+func (it *KcpListener) Addr() net.Addr {
+	return it.listener.Addr()
+}
+
+// KcpClient 在一个KCP会话上复用绑定连接及转发连接
+type KcpClient struct {
+	address string
+	lock    sync.Mutex
+	session *smux.Session
+}
+
+// NewKcpClient 创建到address（host:port）的KCP客户端
+func NewKcpClient(address string) *KcpClient {
+	return &KcpClient{address: address}
+}
+
+// DialBind 建立新的会话并打开绑定连接，绑定连接关闭后，会话在其上的流全部结束后关闭
+func (it *KcpClient) DialBind() (net.Conn, error) {
+	conn, err := kcp.DialWithOptions(it.address, nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	tuneKcp(conn)
+	session, err := smux.Client(conn, smuxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	stream, err := openStream(session, 0)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	it.lock.Lock()
+	it.session = session
+	it.lock.Unlock()
+	return &kcpBindConn{Conn: stream, session: session}, nil
+}
+
+// 绑定连接，关闭时释放会话
+type kcpBindConn struct {
+	net.Conn
+	session   *smux.Session
+	closeOnce sync.Once
+}
+
+func (it *kcpBindConn) Close() error {
+	err := it.Conn.Close()
+	it.closeOnce.Do(func() {
+		go closeWhenIdle(it.session)
+	})
+	return err
+}
+
+// DialRelay 在当前会话上打开转发连接，streamID为绑定时WAN分配的标识
+func (it *KcpClient) DialRelay(streamID int) (net.Conn, error) {
+	it.lock.Lock()
+	session := it.session
+	it.lock.Unlock()
+	if session == nil || session.IsClosed() {
+		return nil, errors.New("kcp session is closed")
+	}
+	return openStream(session, streamID)
+}
+
+func openStream(session *smux.Session, streamID int) (net.Conn, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeStreamID(stream, streamID); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// 等待会话上正在转发的流结束后关闭
+func closeWhenIdle(session *smux.Session) {
+	for !session.IsClosed() && session.NumStreams() > 0 {
+		time.Sleep(time.Second)
+	}
+	session.Close()
+}
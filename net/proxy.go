@@ -0,0 +1,192 @@
+package nets
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"tcp-tunnel/core"
+	"time"
+)
+
+const (
+	// ProxySocks5 SOCKS5代理协议
+	ProxySocks5 = "socks5"
+	// ProxyHttp HTTP CONNECT代理协议
+	ProxyHttp = "http"
+)
+
+// ProxyRequest 用户通过代理协议请求的目标
+type ProxyRequest struct {
+	Protocol string
+	// 目标地址，如 "10.0.0.1:22"
+	Address string
+	conn    net.Conn
+}
+
+// AcceptProxy 读取用户的SOCKS5（无认证）或HTTP CONNECT请求
+func AcceptProxy(conn net.Conn, ioTimeout int) (*ProxyRequest, error) {
+	if ioTimeout > 0 {
+		defer conn.SetDeadline(time.Time{})
+		conn.SetDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
+	}
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return nil, err
+	}
+	if first[0] == 0x05 {
+		return acceptSocks5(conn)
+	}
+	return acceptHttpConnect(conn, first[0])
+}
+
+// SOCKS5: VER NMETHODS METHODS -> VER METHOD, VER CMD RSV ATYP DST.ADDR DST.PORT
+func acceptSocks5(conn net.Conn) (*ProxyRequest, error) {
+	// 认证方式
+	buff := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buff[:1]); err != nil {
+		return nil, err
+	}
+	methods := buff[:buff[0]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	noAuth := false
+	for _, method := range methods {
+		if method == 0x00 {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		conn.Write([]byte{0x05, 0xff})
+		return nil, errors.New("socks5 no acceptable auth method")
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return nil, err
+	}
+
+	// 请求
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0x05 {
+		return nil, fmt.Errorf("socks5 version %d not supported", header[0])
+	}
+	it := &ProxyRequest{Protocol: ProxySocks5, conn: conn}
+	if header[1] != 0x01 {
+		it.reply(0x07)
+		return nil, fmt.Errorf("socks5 command %d not supported", header[1])
+	}
+	var host string
+	switch header[3] {
+	case 0x01:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case 0x04:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		if _, err := io.ReadFull(conn, buff[:1]); err != nil {
+			return nil, err
+		}
+		domain := buff[:buff[0]]
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		it.reply(0x08)
+		return nil, fmt.Errorf("socks5 address type %d not supported", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	it.Address = net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	return it, nil
+}
+
+// CONNECT host:port HTTP/1.1
+func acceptHttpConnect(conn net.Conn, first byte) (*ProxyRequest, error) {
+	// 逐字节读取请求头，避免读入之后的数据
+	header := []byte{first}
+	buff := make([]byte, 1)
+	for !strings.HasSuffix(string(header), "\r\n\r\n") {
+		if len(header) > 8192 {
+			return nil, errors.New("http proxy header too large")
+		}
+		if _, err := io.ReadFull(conn, buff); err != nil {
+			return nil, err
+		}
+		header = append(header, buff[0])
+	}
+	fields := strings.Fields(strings.SplitN(string(header), "\r\n", 2)[0])
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return nil, errors.New("bad http proxy request")
+	}
+	it := &ProxyRequest{Protocol: ProxyHttp, conn: conn, Address: fields[1]}
+	if fields[0] != "CONNECT" {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\nConnection: close\r\n\r\n"))
+		return nil, fmt.Errorf("http proxy method %s not supported", fields[0])
+	}
+	if _, _, err := net.SplitHostPort(it.Address); err != nil {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n"))
+		return nil, err
+	}
+	return it, nil
+}
+
+// Reply 按LAN的响应消息回复用户
+func (it *ProxyRequest) Reply(message string) error {
+	if it.Protocol == ProxySocks5 {
+		switch message {
+		case "success":
+			return it.reply(0x00)
+		case core.DialNotAllowed:
+			return it.reply(0x02)
+		}
+		return it.reply(0x05)
+	}
+	status := "502 Bad Gateway"
+	switch message {
+	case "success":
+		status = "200 Connection established"
+	case core.DialNotAllowed:
+		status = "403 Forbidden"
+	}
+	_, err := it.conn.Write([]byte("HTTP/1.1 " + status + "\r\n\r\n"))
+	return err
+}
+
+func (it *ProxyRequest) reply(rep byte) error {
+	_, err := it.conn.Write([]byte{0x05, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// RequestDial 网关模式下请求LAN连接目标，返回LAN的响应消息
+func RequestDial(conn net.Conn, address string, ioTimeout int) (string, error) {
+	if ioTimeout > 0 {
+		defer conn.SetDeadline(time.Time{})
+		conn.SetDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
+	}
+	if err := core.WriteObject2Json(conn, &core.DialRequest{
+		Reqeust: core.Reqeust{Action: "dial"},
+		Address: address,
+	}); err != nil {
+		return "", err
+	}
+	response := &core.Response{}
+	if err := core.ReadJson2Object(conn, response); err != nil {
+		return "", err
+	}
+	return response.Message, nil
+}
@@ -0,0 +1,120 @@
+package nets
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"tcp-tunnel/core"
+	"testing"
+)
+
+// 用户发送请求，返回解析的请求、错误及用户收到的回复
+func acceptProxyRequest(request []byte) (*ProxyRequest, error, []byte) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	replies := make(chan []byte, 1)
+	// 内存连接的写入是同步的，请求与回复分开进行
+	go a.Write(request)
+	go func() {
+		reply, _ := io.ReadAll(a)
+		replies <- reply
+	}()
+	proxyRequest, err := AcceptProxy(b, 5)
+	if proxyRequest != nil {
+		proxyRequest.Reply("success")
+	}
+	b.Close()
+	return proxyRequest, err, <-replies
+}
+
+func TestAcceptSocks5(t *testing.T) {
+	greeting := []byte{0x05, 0x02, 0x02, 0x00}
+	cases := map[string][]byte{
+		"10.0.0.1:22":      {0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0, 22},
+		"example.com:443":  append(append([]byte{0x05, 0x01, 0x00, 0x03, 11}, "example.com"...), 0x01, 0xbb),
+		"[2001:db8::1]:80": append(append([]byte{0x05, 0x01, 0x00, 0x04}, net.ParseIP("2001:db8::1")...), 0, 80),
+	}
+	for address, request := range cases {
+		proxyRequest, err, reply := acceptProxyRequest(append(greeting, request...))
+		if err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+		if proxyRequest.Protocol != ProxySocks5 || proxyRequest.Address != address {
+			t.Fatalf("unexpected request %+v, expected %s", proxyRequest, address)
+		}
+		// 选择无认证，请求成功
+		if !bytes.Equal(reply[:2], []byte{0x05, 0x00}) || reply[2] != 0x05 || reply[3] != 0x00 {
+			t.Fatalf("unexpected reply %x", reply)
+		}
+	}
+}
+
+func TestAcceptSocks5Refused(t *testing.T) {
+	// 只支持用户名密码认证
+	_, err, reply := acceptProxyRequest([]byte{0x05, 0x01, 0x02})
+	if err == nil || !bytes.Equal(reply, []byte{0x05, 0xff}) {
+		t.Fatalf("no acceptable auth: %x, %v", reply, err)
+	}
+	// BIND命令
+	_, err, reply = acceptProxyRequest([]byte{0x05, 0x01, 0x00, 0x05, 0x02, 0x00, 0x01, 10, 0, 0, 1, 0, 22})
+	if err == nil || len(reply) < 4 || reply[3] != 0x07 {
+		t.Fatalf("unsupported command: %x, %v", reply, err)
+	}
+	// 未知的地址类型
+	_, err, reply = acceptProxyRequest([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x09})
+	if err == nil || len(reply) < 4 || reply[3] != 0x08 {
+		t.Fatalf("unsupported address type: %x, %v", reply, err)
+	}
+}
+
+func TestAcceptHttpConnect(t *testing.T) {
+	request := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"
+	proxyRequest, err, reply := acceptProxyRequest([]byte(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyRequest.Protocol != ProxyHttp || proxyRequest.Address != "example.com:443" {
+		t.Fatalf("unexpected request %+v", proxyRequest)
+	}
+	if !strings.HasPrefix(string(reply), "HTTP/1.1 200") {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	_, err, reply = acceptProxyRequest([]byte("GET http://example.com/ HTTP/1.1\r\n\r\n"))
+	if err == nil || !strings.HasPrefix(string(reply), "HTTP/1.1 405") {
+		t.Fatalf("GET request: %q, %v", reply, err)
+	}
+	_, err, reply = acceptProxyRequest([]byte("CONNECT example.com HTTP/1.1\r\n\r\n"))
+	if err == nil || !strings.HasPrefix(string(reply), "HTTP/1.1 400") {
+		t.Fatalf("CONNECT without port: %q, %v", reply, err)
+	}
+	if _, err, _ := acceptProxyRequest([]byte("CONNECT\r\n\r\n")); err == nil {
+		t.Fatal("bad http request should fail")
+	}
+}
+
+func TestProxyReply(t *testing.T) {
+	cases := []struct {
+		protocol string
+		message  string
+		expected string
+	}{
+		{ProxyHttp, core.DialNotAllowed, "HTTP/1.1 403"},
+		{ProxyHttp, "dial error", "HTTP/1.1 502"},
+		{ProxySocks5, core.DialNotAllowed, "\x05\x02"},
+		{ProxySocks5, "dial error", "\x05\x05"},
+	}
+	for _, c := range cases {
+		a, b := net.Pipe()
+		go (&ProxyRequest{Protocol: c.protocol, conn: b}).Reply(c.message)
+		reply := make([]byte, len(c.expected))
+		io.ReadFull(a, reply)
+		a.Close()
+		b.Close()
+		if string(reply) != c.expected {
+			t.Fatalf("%s reply to %s: %q, expected %q", c.protocol, c.message, reply, c.expected)
+		}
+	}
+}
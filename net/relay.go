@@ -1,22 +1,81 @@
 package nets
 
 import (
+	"io"
 	"net"
+	"sync"
 	"tcp-tunnel/core"
 	"time"
 )
 
 type DataProcessor func(src []byte) (dest []byte)
 
-func Relay(conn1, conn2 net.Conn, ioTimeout int, cryptor core.Cryptor) {
+// RelayStats 转发统计
+type RelayStats struct {
+	// conn1 -> conn2 的字节数
+	Bytes12 int64
+	// conn2 -> conn1 的字节数
+	Bytes21 int64
+	// 压缩时：conn1读到的（压缩前）字节数，conn2读到的（解压前）字节数，未压缩时与Bytes12、Bytes21一致
+	Plain12      int64
+	Compressed21 int64
+	// 先断开的一端（1 或 2）
+	Closer int
+	// 断开原因：eof, timeout, error
+	Reason string
+}
+
+// CloseReason 断开原因，如 "client eof"
+func (it *RelayStats) CloseReason(name1, name2 string) string {
+	if it.Closer == 1 {
+		return name1 + " " + it.Reason
+	}
+	return name2 + " " + it.Reason
+}
+
+// CompressRatio 压缩比（压缩前/压缩后），未压缩或无数据时为1
+func (it *RelayStats) CompressRatio() float64 {
+	compressed := it.Bytes12 + it.Compressed21
+	if compressed == 0 {
+		return 1
+	}
+	return float64(it.Plain12+it.Bytes21) / float64(compressed)
+}
+
+// Relay 双向转发，conn2一侧的数据经compressor压缩（可为空）后由cryptor加密（可为空）
+func Relay(conn1, conn2 net.Conn, ioTimeout int, cryptor core.Cryptor, compressor core.Compressor) *RelayStats {
+
+	stats := &RelayStats{}
+	// 记录先断开的一端
+	var closeOnce sync.Once
+	closeBy := func(closer int, err error) {
+		closeOnce.Do(func() {
+			stats.Closer = closer
+			if err == io.EOF {
+				stats.Reason = "eof"
+			} else if ParseNetError(err) == NetErrorTimeout {
+				stats.Reason = "timeout"
+			} else {
+				stats.Reason = "error"
+			}
+		})
+	}
+
+	// 压缩时使用较大的块，压缩率更高
+	buffSize := 1024
+	if compressor != nil {
+		buffSize = 32 * 1024
+	}
 
 	// 超时起始时间
 	var lastIoTime time.Time = time.Now()
 	// 下行
+	done := make(chan bool)
 	go func() {
+		defer close(done)
 		defer conn1.Close()
 		defer conn2.Close()
-		buff := make([]byte, 1024)
+		buff := make([]byte, buffSize)
 		for {
 			if ioTimeout != 0 {
 				conn1.SetReadDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
@@ -26,19 +85,25 @@ func Relay(conn1, conn2 net.Conn, ioTimeout int, cryptor core.Cryptor) {
 				if ParseNetError(err) == NetErrorTimeout && time.Since(lastIoTime) < time.Duration(ioTimeout)*time.Second {
 					continue
 				}
+				closeBy(1, err)
 				break
 			}
 			lastIoTime = time.Now()
 
+			stats.Plain12 += int64(size)
+
 			// 数据处理
 			var buff2 = buff[:size]
+			if compressor != nil {
+				buff2 = compressor.Compress(buff2)
+			}
 			// fmt.Println("100.1", len(buff2))
 			if cryptor != nil {
-				buff2 = make([]byte, size)
-				cryptor.Encrypt(buff[:size], buff2)
+				buff2 = cryptor.Encrypt(buff2)
 			}
 			// fmt.Println("100.2", len(buff2))
-			conn2.Write(buff2)
+			written, _ := conn2.Write(buff2)
+			stats.Bytes12 += int64(written)
 		}
 	}()
 
@@ -46,7 +111,7 @@ func Relay(conn1, conn2 net.Conn, ioTimeout int, cryptor core.Cryptor) {
 	func() {
 		defer conn1.Close()
 		defer conn2.Close()
-		buff := make([]byte, 1024)
+		buff := make([]byte, buffSize)
 		for {
 			if ioTimeout != 0 {
 				conn2.SetReadDeadline(time.Now().Add(time.Duration(ioTimeout) * time.Second))
@@ -56,19 +121,42 @@ func Relay(conn1, conn2 net.Conn, ioTimeout int, cryptor core.Cryptor) {
 				if ParseNetError(err) == NetErrorTimeout && time.Since(lastIoTime) < time.Duration(ioTimeout)*time.Second {
 					continue
 				}
+				closeBy(2, err)
 				break
 			}
 			lastIoTime = time.Now()
+			stats.Compressed21 += int64(size)
 			// 数据处理
 			var buff2 = buff[:size]
 			// fmt.Println("200.1", len(buff2))
 			if cryptor != nil {
-				buff2 = make([]byte, size)
-				cryptor.Decrypt(buff[:size], buff2)
+				buff2, err = cryptor.Decrypt(buff2)
+				if err != nil {
+					closeBy(2, err)
+					break
+				}
+				if len(buff2) == 0 {
+					continue
+				}
+			}
+			if compressor != nil {
+				buff2, err = compressor.Decompress(buff2)
+				if err != nil {
+					closeBy(2, err)
+					break
+				}
+				if len(buff2) == 0 {
+					continue
+				}
 			}
 
 			// fmt.Println("200.2", len(buff2))
-			conn1.Write(buff2)
+			written, _ := conn1.Write(buff2)
+			stats.Bytes21 += int64(written)
 		}
 	}()
+
+	// 等待下行结束，统计完整
+	<-done
+	return stats
 }
@@ -0,0 +1,89 @@
+package nets
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// UnixScheme unix socket地址的前缀，如 "unix:///var/run/docker.sock"
+const UnixScheme = "unix://"
+
+// IsUnixAddress 是否为unix socket地址
+func IsUnixAddress(address string) bool {
+	return strings.HasPrefix(address, UnixScheme)
+}
+
+// ResolveAddr 解析TCP地址（ip:port）或unix socket地址（unix:///path）
+func ResolveAddr(address string) (net.Addr, error) {
+	if IsUnixAddress(address) {
+		path := strings.TrimPrefix(address, UnixScheme)
+		if path == "" {
+			return nil, fmt.Errorf("the unix socket path is mandatory: %s", address)
+		}
+		return &net.UnixAddr{Name: path, Net: "unix"}, nil
+	}
+	return net.ResolveTCPAddr("tcp", address)
+}
+
+// ListenUnix 监听unix socket，清理残留的socket文件，mode不为0时设置文件权限
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// 仍有进程在监听时不删除
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if mode == 0 {
+		return net.Listen("unix", path)
+	}
+	return listenUnixMode(path, mode)
+}
+
+// 在私有（0700）的临时目录中监听并设置权限后再移到path，避免设置权限前被连接
+func listenUnixMode(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".tcprp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	// 名称尽量短，unix socket的路径长度有限
+	tempPath := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tempPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// 关闭时删除的是移动后的文件
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(tempPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// 关闭时删除socket文件的监听器
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (it *unixListener) Close() error {
+	err := it.UnixListener.Close()
+	os.Remove(it.path)
+	return err
+}
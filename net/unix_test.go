@@ -0,0 +1,46 @@
+//go:build !windows
+
+package nets
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tcprp.sock")
+	listener, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode %s, expected 0600 socket", info.Mode())
+	}
+	// 临时目录已清理
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d files left in the socket directory", len(entries))
+	}
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// 关闭时删除socket文件
+	listener.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file not removed on close: %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package nets
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"tcp-tunnel/core"
+	"time"
+)
+
+// RFC6455 握手用的GUID
+const websocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// 帧类型
+const (
+	websocketContinuation = 0x0
+	websocketBinary       = 0x2
+	websocketClose        = 0x8
+	websocketPing         = 0x9
+	websocketPong         = 0xa
+)
+
+// 单帧的最大长度
+const websocketMaxFrame = 16 * 1024 * 1024
+
+// IsWebSocketURL 是否为WebSocket地址（ws:// 或 wss://）
+func IsWebSocketURL(address string) bool {
+	return strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")
+}
+
+// DialWebSocket 经dialer连接WebSocket服务，返回以二进制帧传输的连接
+func DialWebSocket(u *url.URL, dialer *Dialer) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	conn, err := dialer.Dial(host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: true})
+	}
+	wsConn, err := websocketClientHandshake(conn, u, dialer.Timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return wsConn, nil
+}
+
+// 客户端的升级请求
+func websocketClientHandshake(conn net.Conn, u *url.URL, timeout time.Duration) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce, err := core.RandBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request := "GET " + u.RequestURI() + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: "GET"})
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade error: %s", response.Status)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, errors.New("websocket accept not match")
+	}
+	return &websocketConn{Conn: conn, reader: reader, client: true}, nil
+}
+
+// IsWebSocketRequest 是否为WebSocket的升级请求
+func IsWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// AcceptWebSocket 响应升级请求，返回以二进制帧传输的连接
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !IsWebSocketRequest(r) || key == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, errors.New("not a websocket request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Upgrade Required", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket version not supported")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, errors.New("websocket hijack not supported")
+	}
+	conn, buff, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocketConn{Conn: conn, reader: buff.Reader}, nil
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGuid)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// 以WebSocket二进制帧传输的连接
+type websocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// 客户端发送的帧需要掩码
+	client bool
+	// 当前帧未读的长度及掩码
+	remain    int64
+	mask      []byte
+	maskIndex int
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func (it *websocketConn) Read(b []byte) (int, error) {
+	for it.remain == 0 {
+		if err := it.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > it.remain {
+		b = b[:it.remain]
+	}
+	size, err := it.reader.Read(b)
+	it.remain -= int64(size)
+	if it.mask != nil {
+		for i := 0; i < size; i++ {
+			b[i] ^= it.mask[it.maskIndex%4]
+			it.maskIndex++
+		}
+	}
+	return size, err
+}
+
+// 读取下一个数据帧的头部，并处理控制帧
+func (it *websocketConn) readHeader() error {
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(it.reader, header); err != nil {
+			return err
+		}
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := int64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(it.reader, ext); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(it.reader, ext); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint64(ext))
+		}
+		if length < 0 || length > websocketMaxFrame {
+			return errors.New("websocket frame too large")
+		}
+		var mask []byte
+		if masked {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(it.reader, mask); err != nil {
+				return err
+			}
+		}
+
+		switch opcode {
+		case websocketBinary, websocketContinuation:
+			it.remain, it.mask, it.maskIndex = length, mask, 0
+			return nil
+		case websocketClose:
+			it.writeFrame(websocketClose, nil)
+			return io.EOF
+		default:
+			// 控制帧或文本帧：读出负载
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(it.reader, payload); err != nil {
+				return err
+			}
+			for i := range payload {
+				if mask != nil {
+					payload[i] ^= mask[i%4]
+				}
+			}
+			if opcode == websocketPing {
+				it.writeFrame(websocketPong, payload)
+			}
+		}
+	}
+}
+
+func (it *websocketConn) Write(b []byte) (int, error) {
+	if err := it.writeFrame(websocketBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (it *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	it.writeLock.Lock()
+	defer it.writeLock.Unlock()
+
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte = 0
+	if it.client {
+		maskBit = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	if it.client {
+		mask, err := core.RandBytes(4)
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+		for i, c := range payload {
+			frame = append(frame, c^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := it.Conn.Write(frame)
+	return err
+}
+
+func (it *websocketConn) Close() error {
+	it.closeOnce.Do(func() {
+		it.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		it.writeFrame(websocketClose, nil)
+	})
+	return it.Conn.Close()
+}
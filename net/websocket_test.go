@@ -0,0 +1,166 @@
+package nets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 内存连接两端的WebSocket连接
+func websocketPair() (*websocketConn, *websocketConn) {
+	a, b := net.Pipe()
+	client := &websocketConn{Conn: a, reader: bufio.NewReader(a), client: true}
+	server := &websocketConn{Conn: b, reader: bufio.NewReader(b)}
+	return client, server
+}
+
+func TestWebSocketFraming(t *testing.T) {
+	client, server := websocketPair()
+	defer server.Close()
+	defer client.Conn.Close()
+	for _, size := range []int{0, 1, 125, 126, 65535, 65536, 100000} {
+		payload := bytes.Repeat([]byte{byte(size)}, size)
+		go client.Write(payload)
+		received := make([]byte, size)
+		if _, err := io.ReadFull(server, received); err != nil {
+			t.Fatalf("read %d bytes error: %v", size, err)
+		}
+		if !bytes.Equal(received, payload) {
+			t.Fatalf("payload of %d bytes not match", size)
+		}
+	}
+	// 服务端到客户端
+	go server.Write([]byte("reply"))
+	received := make([]byte, 5)
+	if _, err := io.ReadFull(client, received); err != nil || string(received) != "reply" {
+		t.Fatalf("read reply: %q, %v", received, err)
+	}
+}
+
+func TestWebSocketMasked(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client := &websocketConn{Conn: a, reader: bufio.NewReader(a), client: true}
+	go client.Write([]byte("hello"))
+	frame := make([]byte, 2+4+5)
+	if _, err := io.ReadFull(b, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != 0x80|websocketBinary || frame[1] != 0x80|5 {
+		t.Fatalf("unexpected frame header %x", frame[:2])
+	}
+	// 客户端的帧带掩码，负载不是明文
+	if bytes.Equal(frame[6:], []byte("hello")) {
+		t.Fatal("the client frame is not masked")
+	}
+	for i := range frame[6:] {
+		frame[6+i] ^= frame[2+i%4]
+	}
+	if string(frame[6:]) != "hello" {
+		t.Fatalf("unmasked payload %q", frame[6:])
+	}
+}
+
+func TestWebSocketPingAndClose(t *testing.T) {
+	a, b := net.Pipe()
+	server := &websocketConn{Conn: b, reader: bufio.NewReader(b)}
+	defer server.Close()
+	defer a.Close()
+
+	// ping后的数据帧，服务端回复pong
+	go func() {
+		a.Write([]byte{0x80 | websocketPing, 4, 'p', 'i', 'n', 'g'})
+		a.Write([]byte{0x80 | websocketBinary, 4, 'd', 'a', 't', 'a'})
+	}()
+	read := make(chan []byte, 1)
+	go func() {
+		data := make([]byte, 4)
+		io.ReadFull(server, data)
+		read <- data
+	}()
+	pong := make([]byte, 6)
+	if _, err := io.ReadFull(a, pong); err != nil {
+		t.Fatal(err)
+	}
+	if pong[0] != 0x80|websocketPong || string(pong[2:]) != "ping" {
+		t.Fatalf("unexpected pong %x", pong)
+	}
+	if data := <-read; string(data) != "data" {
+		t.Fatalf("unexpected data %q", data)
+	}
+
+	// 关闭帧：回复关闭帧并返回EOF
+	go a.Write([]byte{0x80 | websocketClose, 0})
+	closed := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		closed <- err
+	}()
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(a, reply); err != nil || reply[0] != 0x80|websocketClose {
+		t.Fatalf("unexpected close reply %x, %v", reply, err)
+	}
+	if err := <-closed; err != io.EOF {
+		t.Fatalf("close frame error %v, expected EOF", err)
+	}
+}
+
+func TestWebSocketFrameTooLarge(t *testing.T) {
+	a, b := net.Pipe()
+	server := &websocketConn{Conn: b, reader: bufio.NewReader(b)}
+	defer server.Close()
+	defer a.Close()
+	header := []byte{0x80 | websocketBinary, 127}
+	header = binary.BigEndian.AppendUint64(header, websocketMaxFrame+1)
+	go a.Write(header)
+	_, err := server.Read(make([]byte, 1))
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("oversize frame error %v, expected too large", err)
+	}
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := AcceptWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+	defer httpServer.Close()
+
+	u, _ := url.Parse(strings.Replace(httpServer.URL, "http://", "ws://", 1) + "/tcprp")
+	conn, err := DialWebSocket(u, &Dialer{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("echo")); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, 4)
+	if _, err := io.ReadFull(conn, received); err != nil || string(received) != "echo" {
+		t.Fatalf("echo over websocket: %q, %v", received, err)
+	}
+
+	// 非升级请求
+	response, err := http.Get(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain request status %d, expected 400", response.StatusCode)
+	}
+}
@@ -0,0 +1,79 @@
+package tunneltest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Backend 本地的应用服务
+type Backend struct {
+	// 监听地址，如 "127.0.0.1:41234"
+	Address  string
+	listener net.Listener
+	conns    sync.Map
+	server   *http.Server
+}
+
+// NewEchoServer 启动回显服务，原样返回收到的数据
+func NewEchoServer() (*Backend, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	it := &Backend{Address: listener.Addr().String(), listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			it.conns.Store(conn, true)
+			go func() {
+				defer it.conns.Delete(conn)
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return it, nil
+}
+
+// NewHTTPServer 启动HTTP服务
+func NewHTTPServer(handler http.Handler) (*Backend, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	it := &Backend{
+		Address:  listener.Addr().String(),
+		listener: listener,
+		server:   &http.Server{Handler: handler},
+	}
+	go it.server.Serve(listener)
+	return it, nil
+}
+
+// Close 关闭服务及所有连接
+func (it *Backend) Close() {
+	if it.server != nil {
+		it.server.Close()
+		return
+	}
+	it.listener.Close()
+	it.conns.Range(func(key, value interface{}) bool {
+		key.(net.Conn).Close()
+		return true
+	})
+}
+
+// FreeAddress 获取一个空闲的本地地址，如 "127.0.0.1:41235"
+func FreeAddress() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}
@@ -0,0 +1,109 @@
+package tunneltest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// CheckEcho 连接地址发送数据，检查回显的数据一致（应用为回显服务时）
+func CheckEcho(address string, payload []byte, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return CheckEchoConn(conn, payload, timeout)
+}
+
+// CheckEchoConn 在已有的连接上检查回显
+func CheckEchoConn(conn net.Conn, payload []byte, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(payload); err != nil {
+		return fmt.Errorf("write echo error: %s", err.Error())
+	}
+	received := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		return fmt.Errorf("read echo error: %s", err.Error())
+	}
+	if !bytes.Equal(received, payload) {
+		return fmt.Errorf("echo not match")
+	}
+	return nil
+}
+
+// ExpectNoEcho 检查不能得到原样的回显，如未经CLIENT解密直接访问加密的开放端口
+func ExpectNoEcho(address string, payload []byte, timeout time.Duration) error {
+	if err := CheckEcho(address, payload, timeout); err == nil {
+		return fmt.Errorf("unexpected echo from %s", address)
+	}
+	return nil
+}
+
+// CheckHTTP 请求地址（如 "http://127.0.0.1:8080/"），检查状态码及返回内容
+func CheckHTTP(url string, statusCode int, body string, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != statusCode {
+		return fmt.Errorf("status code %d, expected %d", response.StatusCode, statusCode)
+	}
+	if string(data) != body {
+		return fmt.Errorf("body %q, expected %q", string(data), body)
+	}
+	return nil
+}
+
+// ExpectClosed 检查连接在指定时间内被对端关闭，如空闲超时
+func ExpectClosed(conn net.Conn, within time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(within))
+	defer conn.SetReadDeadline(time.Time{})
+	buff := make([]byte, 1024)
+	for {
+		_, err := conn.Read(buff)
+		if err == nil {
+			continue
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return fmt.Errorf("connection still open after %s", within)
+		}
+		return nil
+	}
+}
+
+// ExpectRefused 检查地址不可用：连接失败或连接后立即被关闭
+func ExpectRefused(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return ExpectClosed(conn, timeout)
+}
+
+// 等待地址开始监听
+func waitListening(address string, timeout time.Duration) error {
+	startTime := time.Now()
+	for {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Since(startTime) >= timeout {
+			return fmt.Errorf("wait %s listening timeout", address)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,239 @@
+// Package tunneltest 在同一进程内启动WAN、LAN及CLIENT（回环地址及随机端口），
+// 用于端到端地检查转发、加密、TLS、重连及超时，如：
+//
+//	backend, _ := tunneltest.NewEchoServer()
+//	defer backend.Close()
+//	tunnel, err := tunneltest.Start(backend.Address, &tunneltest.Options{EncryptKey: "key", Client: true})
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer tunnel.Close()
+//	if err := tunneltest.CheckEcho(tunnel.Entry(), []byte("hello"), 5*time.Second); err != nil {
+//		t.Fatal(err)
+//	}
+package tunneltest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"tcp-tunnel/client"
+	"tcp-tunnel/lan"
+	"tcp-tunnel/logger"
+	"tcp-tunnel/wan"
+	"time"
+)
+
+// Options 隧道的选项，未设置的配置使用默认值
+type Options struct {
+	// 绑定握手密钥
+	HandshakeKey string
+	// 转发流量的加密密钥
+	EncryptKey string
+	// 绑定连接使用TLS（自动生成自签名证书）
+	TLS bool
+	// 是否启动CLIENT端（加密时需要）
+	Client bool
+	// 修改各端的配置，如套用部署环境的配置
+	WAN    func(config *wan.Config)
+	LAN    func(config *lan.Config)
+	CLIENT func(config *client.Config)
+	// 日志，为空时不输出
+	Log *logger.Logger
+	// 等待首次绑定的超时（默认10秒）
+	BindTimeout time.Duration
+}
+
+// Tunnel 一组运行中的WAN、LAN及CLIENT
+type Tunnel struct {
+	// WAN的绑定地址
+	BindAddress string
+	// WAN上的开放端口
+	OpenAddress string
+	// CLIENT的本地端口（未启动CLIENT时为空）
+	ClientAddress string
+
+	Server *wan.Server
+	Agent  *lan.Agent
+	Client *client.Client
+
+	wanConfig    wan.Config
+	lanConfig    lan.Config
+	clientConfig client.Config
+	// LAN的绑定事件
+	bound   chan string
+	certDir string
+}
+
+// Start 启动一个转发到应用地址的隧道，并等待LAN绑定成功
+func Start(application string, options *Options) (*Tunnel, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	it := &Tunnel{bound: make(chan string, 16)}
+
+	var err error
+	if it.BindAddress, err = FreeAddress(); err != nil {
+		return nil, err
+	}
+	if it.OpenAddress, err = FreeAddress(); err != nil {
+		return nil, err
+	}
+
+	// WAN
+	it.wanConfig = wan.DefaultConfig()
+	it.wanConfig.BindAddress = it.BindAddress
+	it.wanConfig.HandshakeKey = options.HandshakeKey
+	it.wanConfig.Log = options.Log
+	if options.TLS {
+		if it.certDir, err = os.MkdirTemp("", "tunneltest"); err != nil {
+			return nil, err
+		}
+		if it.wanConfig.TlsCertificate, it.wanConfig.TlsPrivateKey, err = writeSelfSignedCert(it.certDir); err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+	if options.WAN != nil {
+		options.WAN(&it.wanConfig)
+	}
+
+	// LAN
+	it.lanConfig = lan.DefaultConfig()
+	it.lanConfig.ServerAddresses = []string{it.BindAddress}
+	it.lanConfig.ApplicationAddresses = []string{application}
+	it.lanConfig.OpenAddress = it.OpenAddress
+	it.lanConfig.ClientName = "tunneltest"
+	it.lanConfig.HandshakeKey = options.HandshakeKey
+	it.lanConfig.EncryptKey = options.EncryptKey
+	it.lanConfig.Tls = options.TLS
+	it.lanConfig.Log = options.Log
+	if options.LAN != nil {
+		options.LAN(&it.lanConfig)
+	}
+	onBind := it.lanConfig.OnBind
+	it.lanConfig.OnBind = func(server string) {
+		select {
+		case it.bound <- server:
+		default:
+		}
+		if onBind != nil {
+			onBind(server)
+		}
+	}
+
+	if err := it.StartServer(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	if err := it.StartAgent(); err != nil {
+		it.Close()
+		return nil, err
+	}
+
+	// CLIENT
+	if options.Client {
+		if it.ClientAddress, err = FreeAddress(); err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.clientConfig = client.DefaultConfig()
+		it.clientConfig.ServerAddress = it.OpenAddress
+		it.clientConfig.LocalAddress = it.ClientAddress
+		it.clientConfig.EncryptKey = options.EncryptKey
+		it.clientConfig.Log = options.Log
+		if options.CLIENT != nil {
+			options.CLIENT(&it.clientConfig)
+		}
+		if it.Client, err = client.NewClient(it.clientConfig); err != nil {
+			it.Close()
+			return nil, err
+		}
+		go it.Client.Run(context.Background())
+		if err := waitListening(it.ClientAddress, 5*time.Second); err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+
+	// 等待绑定
+	bindTimeout := options.BindTimeout
+	if bindTimeout == 0 {
+		bindTimeout = 10 * time.Second
+	}
+	if err := it.WaitBound(bindTimeout); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
+
+// Entry 用户的访问地址：启动CLIENT时为CLIENT的本地端口，否则为开放端口
+func (it *Tunnel) Entry() string {
+	if it.ClientAddress != "" {
+		return it.ClientAddress
+	}
+	return it.OpenAddress
+}
+
+// WaitBound 等待LAN的下一次绑定成功
+// LAN连接失败后约5秒重试一次，检查重连时超时应大于5秒
+func (it *Tunnel) WaitBound(timeout time.Duration) error {
+	select {
+	case <-it.bound:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("wait bind timeout after %s", timeout)
+	}
+}
+
+// StartServer 启动WAN（已停止时用于模拟WAN恢复）
+func (it *Tunnel) StartServer() error {
+	server, err := wan.NewServer(it.wanConfig)
+	if err != nil {
+		return err
+	}
+	it.Server = server
+	go server.Run(context.Background())
+	return waitListening(it.BindAddress, 5*time.Second)
+}
+
+// StopServer 停止WAN，LAN将断开并不断重连
+func (it *Tunnel) StopServer() {
+	if it.Server != nil {
+		it.Server.Close()
+		it.Server = nil
+	}
+}
+
+// StartAgent 启动LAN（已停止时用于模拟LAN重连）
+func (it *Tunnel) StartAgent() error {
+	agent, err := lan.NewAgent(it.lanConfig)
+	if err != nil {
+		return err
+	}
+	it.Agent = agent
+	go agent.Run(context.Background())
+	return nil
+}
+
+// StopAgent 停止LAN，WAN在宽限期内保留开放端口
+func (it *Tunnel) StopAgent() {
+	if it.Agent != nil {
+		it.Agent.Close()
+		it.Agent = nil
+	}
+}
+
+// Close 停止所有端并清理临时文件
+func (it *Tunnel) Close() {
+	if it.Client != nil {
+		it.Client.Close()
+		it.Client = nil
+	}
+	it.StopAgent()
+	it.StopServer()
+	if it.certDir != "" {
+		os.RemoveAll(it.certDir)
+	}
+}
@@ -0,0 +1,156 @@
+package tunneltest
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"tcp-tunnel/lan"
+	"tcp-tunnel/wan"
+	"testing"
+	"time"
+)
+
+const checkTimeout = 5 * time.Second
+
+func startEcho(t *testing.T, options *Options) *Tunnel {
+	backend, err := NewEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(backend.Close)
+	tunnel, err := Start(backend.Address, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tunnel.Close)
+	return tunnel
+}
+
+func TestPlain(t *testing.T) {
+	tunnel := startEcho(t, nil)
+	if err := CheckEcho(tunnel.Entry(), []byte("hello"), checkTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// 较大的数据及多个并发连接
+	payload := bytes.Repeat([]byte("0123456789"), 100000)
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			errs <- CheckEcho(tunnel.Entry(), payload, checkTimeout)
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEncryptedClient(t *testing.T) {
+	tunnel := startEcho(t, &Options{HandshakeKey: "handshake", EncryptKey: "encrypt", Client: true})
+	if err := CheckEcho(tunnel.Entry(), []byte("hello"), checkTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// 不经CLIENT直接访问开放端口得不到明文
+	if err := ExpectNoEcho(tunnel.OpenAddress, []byte("hello"), 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// CLIENT仍然可用
+	if err := CheckEcho(tunnel.Entry(), bytes.Repeat([]byte("x"), 100000), checkTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	tunnel := startEcho(t, &Options{HandshakeKey: "handshake", TLS: true})
+	if err := CheckEcho(tunnel.Entry(), []byte("hello"), checkTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWrongHandshakeKey(t *testing.T) {
+	backend, err := NewEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	_, err = Start(backend.Address, &Options{
+		HandshakeKey: "handshake",
+		LAN:          func(config *lan.Config) { config.HandshakeKey = "wrong" },
+		BindTimeout:  2 * time.Second,
+	})
+	if err == nil {
+		t.Fatal("the LAN with a wrong handshake key should not bind")
+	}
+}
+
+func TestTakeoverRefused(t *testing.T) {
+	var lanConfig *lan.Config
+	tunnel := startEcho(t, &Options{
+		HandshakeKey: "handshake",
+		LAN:          func(config *lan.Config) { lanConfig = config },
+	})
+	// 相同客户端标识的另一个LAN没有接管密钥，不能接管
+	config := *lanConfig
+	bound := make(chan string, 1)
+	config.OnBind = func(server string) {
+		select {
+		case bound <- server:
+		default:
+		}
+	}
+	agent, err := lan.NewAgent(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	go agent.Run(context.Background())
+	select {
+	case <-bound:
+		t.Fatal("another LAN with the same client name should not take over the binding")
+	case <-time.After(2 * time.Second):
+	}
+	if err := CheckEcho(tunnel.Entry(), []byte("hello"), checkTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerRestart(t *testing.T) {
+	tunnel := startEcho(t, &Options{HandshakeKey: "handshake"})
+	if err := CheckEcho(tunnel.Entry(), []byte("before"), checkTimeout); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.StopServer()
+	if err := ExpectRefused(tunnel.OpenAddress, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	// LAN约5秒后重连
+	if err := tunnel.WaitBound(15 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckEcho(tunnel.Entry(), []byte("after"), checkTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tunnel := startEcho(t, &Options{
+		WAN: func(config *wan.Config) { config.IoTimeout = 1 },
+		LAN: func(config *lan.Config) { config.IoTimeout = 1 },
+	})
+	conn, err := net.DialTimeout("tcp", tunnel.Entry(), checkTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := CheckEchoConn(conn, []byte("hello"), checkTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// 空闲超过超时时间后连接被关闭
+	if err := ExpectClosed(conn, checkTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,93 @@
+package wan
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yymmiinngg/goargs"
+)
+
+// StartBan 查看及解封WAN的封禁列表文件，运行中的WAN在几秒内读取修改
+func StartBan(argsArr []string) {
+
+	template := `
+    Usage: {{COMMAND}} BAN {{OPTION}}
+
+	* -f, --ban-file  # The ban file of the WAN (--ban-file)
+	+ -u, --unban     # Unban the IPs, separated by commas, or "all"
+	? -a, --all       # Also list the expired bans, which still double the next ban
+
+    ? -H, --help      # Show Help and Exit
+`
+
+	// 定义变量
+	var banFile string
+	var unban string
+	var all bool
+
+	// 编译模板
+	args, err := goargs.Compile(template)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	// 绑定变量
+	args.StringOption("-f", &banFile, "")
+	args.StringOption("-u", &unban, "")
+	args.BoolOption("-a", &all, false)
+
+	// 处理参数
+	err = args.Parse(argsArr, goargs.AllowUnknowOption)
+
+	// 显示帮助
+	if args.HasItem("-H", "--help") {
+		fmt.Println(args.Usage())
+		return
+	}
+
+	// 错误输出
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	bans, err := ReadBanFile(banFile)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	// 解封
+	if unban != "" {
+		ips := map[string]bool{}
+		for _, ip := range strings.Split(unban, ",") {
+			ips[strings.TrimSpace(ip)] = true
+		}
+		kept := []Ban{}
+		for _, ban := range bans {
+			if ips["all"] || ips[ban.IP] {
+				fmt.Println("unban", ban.IP)
+				continue
+			}
+			kept = append(kept, ban)
+		}
+		if err := WriteBanFile(banFile, kept); err != nil {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
+	// 列表
+	for _, ban := range bans {
+		if !ban.Active() && !all {
+			continue
+		}
+		state := "banned"
+		if !ban.Active() {
+			state = "expired"
+		}
+		fmt.Printf("%-40s %-8s %s  %d times\n", ban.IP, state, ban.Until.Local().Format(time.RFC3339), ban.Count)
+	}
+}
@@ -0,0 +1,149 @@
+package wan
+
+import (
+	"net"
+	"strings"
+	"tcp-tunnel/core"
+	"tcp-tunnel/logger"
+	nets "tcp-tunnel/net"
+)
+
+// Config WAN服务的配置
+type Config struct {
+	// 绑定端口，如 "0.0.0.0:3390"，以 "kcp://" 开头时监听UDP端口，LAN以KCP连接（丢包较多的链路）
+	BindAddress string
+	// 绑定连接的握手密钥
+	HandshakeKey string
+	// 访问密钥：CLIENT以此（代替握手密钥）经绑定端口访问秘密绑定，只能访问，为空时不使用
+	VisitKey string
+	// 绑定令牌的密钥：HMAC密钥，或 "ed25519:" 开头的Ed25519公钥（或私钥），设置后LAN须带有效的令牌绑定
+	TokenKey string
+	// 转发的读写超时（单位：秒）
+	IoTimeout int
+	// LAN绑定断开后保留开放端口的时间（单位：秒），0为立即关闭
+	GracePeriod int
+	// 多个LAN绑定同一开放端口时的负载策略
+	BalancePolicy string
+	// TLS的证书及私钥文件，为空时使用TCP
+	TlsCertificate string
+	TlsPrivateKey  string
+	// 转发端口的范围，如 "40000-40100"，为空时为任意端口
+	RelayPorts string
+	// 转发端口对外公布的地址，如 "1.1.1.1"、"1.1.1.1:50000" 或 ":50000"（带端口时为RelayPorts起始端口映射的外部端口），
+	// WAN在NAT、端口映射的负载均衡或容器中时使用
+	RelayAdvertise string
+	// 使用旧版本（版本1）的握手，兼容旧版本的LAN及CLIENT（可被重放）
+	LegacyHandshake bool
+	// 同一IP在10分钟内握手失败达到次数时封禁（绑定端口、转发端口及WebSocket），0为不封禁
+	BanFailures int
+	// 首次封禁的时长（单位：秒），再次封禁时翻倍
+	BanTime int
+	// 封禁列表文件，重启后保留封禁，可由 BAN 命令查看及解封，为空时不保存
+	BanFile string
+	// 单端口模式：LAN（支持时）的转发连接也经绑定端口，不再监听随机的转发端口
+	SinglePort bool
+	// WebSocket的监听地址，如 "0.0.0.0:8080"，为空时不监听（仍可通过Server.WebSocketHandler挂载到已有的Web服务）
+	WebSocketAddress string
+	// WebSocket的HTTP路径
+	WebSocketPath string
+	// 日志，为空时不输出
+	Log *logger.Logger
+	// 事件回调
+	Events
+}
+
+// Events 事件回调，均可为空，回调中不应阻塞
+type Events struct {
+	// LAN绑定（或接管）开放端口
+	OnBind func(clientName, openPort string)
+	// LAN的绑定从开放端口移除
+	OnUnbind func(clientName, openPort string)
+	// 一次转发会话结束
+	OnSession func(record *logger.AccessRecord)
+}
+
+// DefaultConfig 默认配置（与命令行的默认值一致）
+func DefaultConfig() Config {
+	return Config{
+		BindAddress:   "0.0.0.0:3390",
+		IoTimeout:     120,
+		BalancePolicy: BalancePolicyRoundRobin,
+		BanFailures:   5,
+		BanTime:       600,
+		WebSocketPath: "/tcprp",
+	}
+}
+
+// 检查配置，返回绑定地址、转发端口及令牌密钥
+func (it *Config) check() (*net.TCPAddr, *relayPorts, *core.TokenKey, error) {
+	if it.IoTimeout < 1 {
+		return nil, nil, nil, &core.ConfigError{Field: "IoTimeout", Message: "The io timeout duration cannot be less than 1"}
+	}
+
+	if it.GracePeriod < 0 {
+		return nil, nil, nil, &core.ConfigError{Field: "GracePeriod", Message: "The grace period cannot be less than 0"}
+	}
+
+	if it.BalancePolicy != BalancePolicyRoundRobin && it.BalancePolicy != BalancePolicyLeastConn && it.BalancePolicy != BalancePolicyWeighted {
+		return nil, nil, nil, &core.ConfigError{Field: "BalancePolicy", Message: "Unknow balance policy " + it.BalancePolicy}
+	}
+
+	if it.BanFailures < 0 {
+		return nil, nil, nil, &core.ConfigError{Field: "BanFailures", Message: "The ban failures cannot be less than 0"}
+	}
+	if it.BanFailures > 0 && it.BanTime < 1 {
+		return nil, nil, nil, &core.ConfigError{Field: "BanTime", Message: "The ban time cannot be less than 1"}
+	}
+
+	// 证书和密钥必须成对出现
+	if (it.TlsCertificate != "" && it.TlsPrivateKey == "") || (it.TlsCertificate == "" && it.TlsPrivateKey != "") {
+		return nil, nil, nil, &core.ConfigError{Field: "TlsCertificate", Message: "tls certificate and private key must be pair"}
+	}
+
+	// 访问者须能验证WAN（版本2的握手），且不能与握手密钥相同
+	if it.VisitKey != "" && it.LegacyHandshake {
+		return nil, nil, nil, &core.ConfigError{Field: "VisitKey", Message: "The visit key can not be used with the legacy handshake"}
+	}
+	if it.VisitKey != "" && it.VisitKey == it.HandshakeKey {
+		return nil, nil, nil, &core.ConfigError{Field: "VisitKey", Message: "The visit key must differ from the handshake key"}
+	}
+
+	// 令牌经控制连接发送：控制连接的密钥由握手密钥派生，版本1的握手为明文，否则须使用TLS
+	if it.TokenKey != "" && (it.HandshakeKey == "" || it.LegacyHandshake) && it.TlsCertificate == "" {
+		return nil, nil, nil, &core.ConfigError{Field: "TokenKey", Message: "The token key requires the handshake key (without the legacy handshake) or tls to keep tokens secret"}
+	}
+
+	if it.WebSocketAddress != "" && !strings.HasPrefix(it.WebSocketPath, "/") {
+		return nil, nil, nil, &core.ConfigError{Field: "WebSocketPath", Message: "The websocket path must start with /"}
+	}
+
+	// KCP不支持TLS（可使用加密密钥加密转发流量）
+	if nets.IsKcpAddress(it.BindAddress) && it.TlsCertificate != "" {
+		return nil, nil, nil, &core.ConfigError{Field: "TlsCertificate", Message: "tls is not supported with kcp bind address"}
+	}
+
+	// 自动拼接IP
+	bindAddress := strings.TrimPrefix(it.BindAddress, nets.KcpScheme)
+	if strings.HasPrefix(bindAddress, ":") {
+		bindAddress = "0.0.0.0" + bindAddress
+	}
+
+	// 提取tcp地址
+	bindAddr, err := net.ResolveTCPAddr("tcp", bindAddress)
+	if err != nil {
+		return nil, nil, nil, &core.ConfigError{Field: "BindAddress", Message: "resolve bind address error: " + err.Error()}
+	}
+
+	relayPorts, err := parseRelayPorts(bindAddr.IP.String(), it.RelayPorts, it.RelayAdvertise)
+	if err != nil {
+		return nil, nil, nil, &core.ConfigError{Field: "RelayPorts", Message: err.Error()}
+	}
+
+	var tokenKey *core.TokenKey
+	if it.TokenKey != "" {
+		if tokenKey, err = core.ParseTokenKey(it.TokenKey); err != nil {
+			return nil, nil, nil, &core.ConfigError{Field: "TokenKey", Message: err.Error()}
+		}
+	}
+	return bindAddr, relayPorts, tokenKey, nil
+}
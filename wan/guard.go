@@ -0,0 +1,343 @@
+package wan
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"tcp-tunnel/logger"
+	"time"
+)
+
+const (
+	// 统计握手失败次数的时间窗口
+	guardFindTime = 10 * time.Minute
+	// 封禁到期后保留记录的时间，期间再次封禁时长翻倍
+	guardForgetTime = 24 * time.Hour
+	// 封禁时长最多翻倍的次数
+	guardMaxDoubling = 10
+	// 检查封禁文件被修改（如 BAN 命令解封）及清理过期记录的间隔
+	guardReloadInterval = 5 * time.Second
+	// 最多记录失败计数的IP数，已满时淘汰最早的记录
+	guardMaxFailRecords = 65536
+)
+
+// Ban 一个被封禁的IP
+type Ban struct {
+	IP string `json:"ip"`
+	// 封禁到期的时间
+	Until time.Time `json:"until"`
+	// 累计被封禁的次数，每次封禁的时长翻倍
+	Count int `json:"count"`
+}
+
+// Active 是否仍在封禁中
+func (it *Ban) Active() bool {
+	return time.Now().Before(it.Until)
+}
+
+// 握手失败的计数
+type failRecord struct {
+	count int
+	first time.Time
+}
+
+// 绑定及转发端口的防护：握手失败次数过多的IP被临时封禁，重复封禁时长翻倍，为空时不防护
+type guard struct {
+	maxFailures int
+	banTime     time.Duration
+	// 封禁列表文件，为空时不保存
+	file     string
+	failures map[string]*failRecord
+	bans     map[string]*Ban
+	lock     sync.Locker
+	log      *logger.Logger
+	// 上次读写封禁文件时文件的修改时间
+	modTime time.Time
+}
+
+// maxFailures为0时不防护（返回空）
+func newGuard(maxFailures int, banTime int, file string, log *logger.Logger) *guard {
+	if maxFailures <= 0 {
+		return nil
+	}
+	it := &guard{
+		maxFailures: maxFailures,
+		banTime:     time.Duration(banTime) * time.Second,
+		file:        file,
+		failures:    map[string]*failRecord{},
+		bans:        map[string]*Ban{},
+		lock:        &sync.Mutex{},
+		log:         log,
+	}
+	it.reload()
+	return it
+}
+
+// 地址中的IP
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// 是否允许连接（未被封禁）
+func (it *guard) allow(addr net.Addr) bool {
+	if it == nil {
+		return true
+	}
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	ban, ok := it.bans[addrIP(addr)]
+	return !ok || !ban.Active()
+}
+
+// 记录一次验证失败（握手或令牌），达到次数时封禁
+func (it *guard) fail(addr net.Addr) {
+	if it == nil {
+		return
+	}
+	ip := addrIP(addr)
+	it.lock.Lock()
+	defer it.lock.Unlock()
+
+	now := time.Now()
+	record, ok := it.failures[ip]
+	if !ok || now.Sub(record.first) > guardFindTime {
+		if !ok && len(it.failures) >= guardMaxFailRecords {
+			it.evictFailure(now)
+		}
+		record = &failRecord{first: now}
+		it.failures[ip] = record
+	}
+	record.count++
+	it.log.Warn("authentication failed from", ip, "["+strconv.Itoa(record.count)+"/"+strconv.Itoa(it.maxFailures)+"]")
+	if record.count < it.maxFailures {
+		return
+	}
+	delete(it.failures, ip)
+
+	// 封禁，记录未过期时时长翻倍
+	it.load()
+	ban, ok := it.bans[ip]
+	if !ok || now.Sub(ban.Until) > guardForgetTime {
+		ban = &Ban{IP: ip}
+		it.bans[ip] = ban
+	}
+	doubling := ban.Count
+	if doubling > guardMaxDoubling {
+		doubling = guardMaxDoubling
+	}
+	ban.Count++
+	ban.Until = now.Add(it.banTime << doubling)
+	it.log.Warn("ban", ip, "until", ban.Until.Format(time.RFC3339), "- banned", strconv.Itoa(ban.Count), "times")
+	it.save(ip, ban)
+}
+
+// 失败计数已满（已加锁），清理过期的记录，仍满时淘汰最早的记录
+func (it *guard) evictFailure(now time.Time) {
+	oldest := ""
+	for ip, record := range it.failures {
+		if now.Sub(record.first) > guardFindTime {
+			delete(it.failures, ip)
+			continue
+		}
+		if oldest == "" || record.first.Before(it.failures[oldest].first) {
+			oldest = ip
+		}
+	}
+	if len(it.failures) >= guardMaxFailRecords {
+		delete(it.failures, oldest)
+	}
+}
+
+// 清理过期的失败计数及封禁记录
+func (it *guard) purge() {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	now := time.Now()
+	for ip, record := range it.failures {
+		if now.Sub(record.first) > guardFindTime {
+			delete(it.failures, ip)
+		}
+	}
+	for ip, ban := range it.bans {
+		if now.Sub(ban.Until) > guardForgetTime {
+			delete(it.bans, ip)
+		}
+	}
+}
+
+// 握手成功，清除失败计数
+func (it *guard) succeed(addr net.Addr) {
+	if it == nil {
+		return
+	}
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	delete(it.failures, addrIP(addr))
+}
+
+// 封禁中的IP
+func (it *guard) list() []Ban {
+	if it == nil {
+		return nil
+	}
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	bans := []Ban{}
+	for _, ban := range it.bans {
+		if ban.Active() {
+			bans = append(bans, *ban)
+		}
+	}
+	sortBans(bans)
+	return bans
+}
+
+// 解封并清除记录，返回是否存在
+func (it *guard) unban(ip string) bool {
+	if it == nil {
+		return false
+	}
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	delete(it.failures, ip)
+	if _, ok := it.bans[ip]; !ok {
+		return false
+	}
+	delete(it.bans, ip)
+	it.log.Info("unban", ip)
+	it.save(ip, nil)
+	return true
+}
+
+// 保存一个IP的封禁变化（已加锁，ban为空时删除），清理过期的记录。
+// 文件被其他程序修改（如 BAN 命令解封）时先重新读取，不覆盖其他程序的修改
+func (it *guard) save(ip string, ban *Ban) {
+	if it.file == "" {
+		return
+	}
+	it.load()
+	if ban != nil {
+		it.bans[ip] = ban
+	} else {
+		delete(it.bans, ip)
+	}
+	bans := []Ban{}
+	for ip, ban := range it.bans {
+		if time.Since(ban.Until) > guardForgetTime {
+			delete(it.bans, ip)
+			continue
+		}
+		bans = append(bans, *ban)
+	}
+	if err := WriteBanFile(it.file, bans); err != nil {
+		it.log.Error(err, "write ban file error")
+		return
+	}
+	if info, err := os.Stat(it.file); err == nil {
+		it.modTime = info.ModTime()
+	}
+}
+
+// 封禁文件被其他程序修改时重新读取
+func (it *guard) reload() {
+	if it == nil {
+		return
+	}
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	it.load()
+}
+
+// 封禁文件被修改时读取（已加锁）
+func (it *guard) load() {
+	if it.file == "" {
+		return
+	}
+	info, err := os.Stat(it.file)
+	if err != nil {
+		return
+	}
+	if info.ModTime().Equal(it.modTime) {
+		return
+	}
+	bans, err := ReadBanFile(it.file)
+	if err != nil {
+		it.log.Error(err, "read ban file error")
+		return
+	}
+	it.modTime = info.ModTime()
+	it.bans = map[string]*Ban{}
+	for i := range bans {
+		it.bans[bans[i].IP] = &bans[i]
+	}
+	it.log.Debug("load ban file", it.file, "-", strconv.Itoa(len(bans)), "records")
+}
+
+// 循环检查封禁文件并清理过期的记录，done关闭时退出
+func (it *guard) loopReload(done <-chan struct{}) {
+	if it == nil {
+		return
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(guardReloadInterval):
+		}
+		it.reload()
+		it.purge()
+	}
+}
+
+// ReadBanFile 读取封禁列表文件，文件不存在时为空
+func ReadBanFile(file string) ([]Ban, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Ban{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bans := []Ban{}
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// WriteBanFile 写入封禁列表文件（先写临时文件再替换）
+func WriteBanFile(file string, bans []Ban) error {
+	sortBans(bans)
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func sortBans(bans []Ban) {
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+}
@@ -0,0 +1,243 @@
+package wan
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"tcp-tunnel/config"
+	"tcp-tunnel/core"
+	"tcp-tunnel/logger"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 成员按绑定请求的设置，接管时整体替换，转发中的连接读取不加锁
+type memberSettings struct {
+	weight    int
+	encrypted bool
+	// CLIENT的证明密钥，为空时不验证CLIENT
+	proofKey string
+	// LAN提供的加密套件
+	cipherSuites []string
+	handshaker   *core.Handshaker
+}
+
+// 开放端口上的一个LAN绑定
+type relayMember struct {
+	clientName   string
+	settings     atomic.Pointer[memberSettings]
+	lanConns     chan net.Conn
+	lanConnsLock sync.Locker
+	log          *logger.Logger
+	// 转发端口监听器（单端口模式时为空）
+	relayListener net.Listener
+	relayPorts    *relayPorts
+	guard         *guard
+	// 转发端口，监听后设置，读取不加锁
+	relayPort int32
+	// KCP绑定的成员在会话上以此标识转发流，不监听转发端口
+	streamID int32
+	closed   bool
+	// 单端口模式下经绑定端口的转发连接以此标识成员
+	bindingID string
+	// 接管密钥，首次绑定时返回给LAN，重连接管时须一致
+	takeoverKey string
+	// 正在转发的连接数
+	activeConns int32
+	// LAN端的应用是否可用
+	available int32
+	// 加权轮询的当前权重
+	currentWeight int
+	// 当前绑定的连接（为空时处于宽限期）
+	bindConn   net.Conn
+	graceTimer *time.Timer
+}
+
+// 启动成员，listen为false时（单端口模式）不监听转发端口，
+// keyed为false时（绑定的控制连接不保密）转发握手的密钥为空
+func startRelayMember(
+	clientName string,
+	weight int,
+	relayPorts *relayPorts,
+	guard *guard,
+	listen bool,
+	keyed bool,
+	log *logger.Logger,
+) *relayMember {
+
+	// 随机一个密钥
+	handshakerKey := ""
+	if keyed {
+		handshakerKey = uuid.New().String()
+	}
+	it := &relayMember{
+		clientName:   clientName,
+		lanConnsLock: &sync.Mutex{},
+		lanConns:     make(chan net.Conn, 1024),
+		log:          log,
+		available:    1,
+		relayPorts:   relayPorts,
+		guard:        guard,
+		bindingID:    uuid.New().String(),
+		takeoverKey:  uuid.New().String(),
+	}
+	it.settings.Store(&memberSettings{weight: weight, handshaker: core.MakeHandshaker(handshakerKey, false)})
+	if listen && it.listen() != nil {
+		return nil
+	}
+	return it
+}
+
+// 按绑定请求设置成员（加入或接管开放端口时）
+func (it *relayMember) applyBindRequest(bindRequest *core.BindRequest) {
+	legacy := bindRequest.HandshakeVersion < core.HandshakeVersion
+	it.settings.Store(&memberSettings{
+		weight:       bindRequest.Weight,
+		encrypted:    bindRequest.Encrypted,
+		handshaker:   core.MakeHandshaker(it.getSettings().handshaker.UserKey, legacy),
+		proofKey:     bindRequest.ProofKey,
+		cipherSuites: bindRequest.CipherSuites,
+	})
+}
+
+func (it *relayMember) getSettings() *memberSettings {
+	return it.settings.Load()
+}
+
+// 接管密钥是否一致
+func (it *relayMember) matchTakeoverKey(takeoverKey string) bool {
+	return subtle.ConstantTimeCompare([]byte(it.takeoverKey), []byte(takeoverKey)) == 1
+}
+
+// 监听转发端口，已监听时忽略
+func (it *relayMember) listen() error {
+	it.lanConnsLock.Lock()
+	defer it.lanConnsLock.Unlock()
+	if it.relayListener != nil {
+		return nil
+	}
+
+	// 转发端口监听
+	relayListener, err := it.relayPorts.listen()
+	if err != nil {
+		it.log.Error(err, "listen relay port error")
+		return err
+	}
+	it.relayListener = relayListener
+	atomic.StoreInt32(&it.relayPort, int32(relayListener.Addr().(*net.TCPAddr).Port))
+
+	// 处理转发连接
+	go func() {
+		it.log.Info("start relay port:", relayListener.Addr().String(), "-", it.clientName)
+		for {
+			lanConn, err := relayListener.Accept()
+			if err != nil {
+				it.log.Debug("accept relay connection error: " + err.Error())
+				break
+			}
+			if !it.guard.allow(lanConn.RemoteAddr()) {
+				it.log.Debug("refuse banned relay connection", lanConn.RemoteAddr().String())
+				lanConn.Close()
+				continue
+			}
+			it.putRelayConn(lanConn)
+		}
+	}()
+	return nil
+}
+
+// 转发连接放入待命队列（转发端口、WebSocket或绑定端口），已关闭时断开
+func (it *relayMember) putRelayConn(lanConn net.Conn) {
+	it.log.Debug("get a relay connection", strconv.Itoa(len(it.lanConns)+1), lanConn.LocalAddr().String(), "<-", lanConn.RemoteAddr().String())
+	it.lanConnsLock.Lock()
+	defer it.lanConnsLock.Unlock()
+	if it.closed {
+		lanConn.Close()
+		return
+	}
+	it.lanConns <- lanConn
+}
+
+func (it *relayMember) Close() {
+
+	it.lanConnsLock.Lock()
+	defer it.lanConnsLock.Unlock()
+
+	// 关闭监听器
+	it.closed = true
+	if it.relayListener != nil {
+		it.relayListener.Close()
+	}
+
+	// 关闭所有待命连接
+	for len(it.lanConns) > 0 {
+		lanConn := <-it.lanConns
+		lanConn.Close()
+		it.log.Debug("close ready relay connection", lanConn.LocalAddr().String(), "<-", lanConn.RemoteAddr().String())
+	}
+}
+
+// 取一个握手成功的待命连接，无待命连接时立即返回
+func (it *relayMember) pollRelayConn() net.Conn {
+	for {
+		// 获得lan端的连接
+		it.lanConnsLock.Lock()
+		var lanConn net.Conn
+		select {
+		case lanConn = <-it.lanConns:
+		default:
+		}
+		it.lanConnsLock.Unlock()
+		if lanConn == nil {
+			return nil
+		}
+
+		// 通信前握手
+		err := it.getSettings().handshaker.WrHandshake(lanConn, config.WaitTimeout)
+		if err != nil {
+			lanConn.Close()
+			it.log.Debug("handshaker error:", err.Error())
+			if errors.Is(err, core.ErrHandshake) {
+				it.guard.fail(lanConn.RemoteAddr())
+			}
+			continue
+		}
+
+		// 返回可用连接
+		return lanConn
+	}
+}
+
+func (it *relayMember) getStreamID() int32 {
+	return atomic.LoadInt32(&it.streamID)
+}
+
+// 转发端口，未监听时为0
+func (it *relayMember) getRelayPort() int {
+	return int(atomic.LoadInt32(&it.relayPort))
+}
+
+func (it *relayMember) addActive(delta int32) {
+	atomic.AddInt32(&it.activeConns, delta)
+}
+
+func (it *relayMember) active() int32 {
+	return atomic.LoadInt32(&it.activeConns)
+}
+
+func (it *relayMember) isAvailable() bool {
+	return atomic.LoadInt32(&it.available) == 1
+}
+
+// 设置应用可用状态，返回状态是否改变
+func (it *relayMember) setAvailable(available bool) bool {
+	var v int32 = 0
+	if available {
+		v = 1
+	}
+	return atomic.SwapInt32(&it.available, v) != v
+}
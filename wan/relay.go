@@ -1,9 +1,12 @@
 package wan
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"sort"
+	"strings"
 	"sync"
 	"tcp-tunnel/config"
 	"tcp-tunnel/core"
@@ -12,95 +15,103 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// BalancePolicyRoundRobin 轮流使用各个LAN
+	BalancePolicyRoundRobin = "round-robin"
+	// BalancePolicyLeastConn 优先使用转发连接最少的LAN
+	BalancePolicyLeastConn = "least-conn"
+	// BalancePolicyWeighted 按LAN的权重分配
+	BalancePolicyWeighted = "weighted"
 )
 
 type RelayServer struct {
-	relayBindHost  string
+	relayPorts *relayPorts
+	// 握手失败过多的IP的封禁
+	guard          *guard
 	openAddress    string
-	handshaker     *core.Handshaker
 	relayIoTimeout int
-	lanConns       chan net.Conn
-	lanConnsLock   sync.Locker
+	balancePolicy  string
 	log            *logger.Logger
-	// 两个重要的监听器
-	relayListener       net.Listener
+	// 开放端口上的LAN绑定
+	members     []*relayMember
+	membersLock sync.Locker
+	nextMember  int
+	// 应用端口监听器（秘密绑定时为空）
 	applicationListener net.Listener
+	// 秘密绑定的握手
+	secret *core.Handshaker
+	// 正在转发的客户端连接
+	sessions *core.SyncMap
+	// 会话结束的回调
+	onSession func(record *logger.AccessRecord)
 }
 
 func (it *RelayServer) Close() {
 
-	it.lanConnsLock.Lock()
-	defer it.lanConnsLock.Unlock()
+	it.membersLock.Lock()
+	defer it.membersLock.Unlock()
 
 	// 关闭监听器
-	it.relayListener.Close()
-	it.applicationListener.Close()
+	if it.applicationListener != nil {
+		it.applicationListener.Close()
+	}
 
-	// 关闭所有待命连接
-	for len(it.lanConns) > 0 {
-		lanConn := <-it.lanConns
-		lanConn.Close()
-		it.log.Debug("close ready relay connection", lanConn.LocalAddr().String(), "<-", lanConn.RemoteAddr().String())
+	// 关闭所有成员
+	for _, member := range it.members {
+		member.Close()
 	}
+	it.members = nil
 
-	// TODO 关闭正在转发的连接
+	// 关闭正在转发的连接
+	it.sessions.Range(func(key, value interface{}) bool {
+		key.(net.Conn).Close()
+		return true
+	})
 }
 
-// 局域网的连接
+// 局域网的连接，secretKey不为空时为秘密绑定，不监听开放端口
 func StartRelayServer(
-	relayBindHost string,
+	relayPorts *relayPorts,
 	openAddress string,
+	secretKey string,
+	legacyHandshake bool,
 	relayIoTimeout int,
+	balancePolicy string,
 	log *logger.Logger,
+	onSession func(record *logger.AccessRecord),
 ) *RelayServer {
 
-	// 随机一个密钥
-	handshakerKey := uuid.New().String()
 	it := &RelayServer{
-		relayBindHost:  relayBindHost,
+		relayPorts:     relayPorts,
 		openAddress:    openAddress,
-		handshaker:     core.MakeHandshaker(handshakerKey),
 		relayIoTimeout: relayIoTimeout,
-		lanConnsLock:   &sync.Mutex{},
-		lanConns:       make(chan net.Conn, 1024),
-		log:            log,
+		balancePolicy:  balancePolicy,
+		membersLock:    &sync.Mutex{},
+		log:            log.With("binding", openAddress),
+		sessions:       core.MakeSyncMap(16),
+		onSession:      onSession,
 	}
 
-	// 转发端口监听
-	relayListener, err := net.Listen("tcp", net.JoinHostPort(it.relayBindHost, "0")) // 任意端口，跟绑定端口的IP一致
-	if err != nil {
-		it.log.Error(err, "listen relay port error")
-		return nil
+	// 秘密绑定只接受经绑定端口的访问
+	if secretKey != "" {
+		it.secret = core.MakeHandshaker(secretKey, legacyHandshake)
+		it.log.Info("start secret binding")
+		return it
 	}
 
 	// 应用端口监听
 	openListener, err := net.Listen("tcp", it.openAddress)
 	if err != nil {
 		it.log.Error(err, "listen application port error")
-		relayListener.Close() // 关闭转发监听
 		return nil
 	}
 
 	// 保存
-	it.relayListener = relayListener
 	it.applicationListener = openListener
 
-	// 处理转发连接
-	go func() {
-		it.log.Info("start relay port:", relayListener.Addr().String())
-		for {
-			lanConn, err := relayListener.Accept()
-			if err != nil {
-				it.log.Debug("accept relay connection error: " + err.Error())
-				break
-			}
-			it.log.Debug("get a relay connection", strconv.Itoa(len(it.lanConns)+1), lanConn.LocalAddr().String(), "<-", lanConn.RemoteAddr().String())
-			it.lanConnsLock.Lock()
-			it.lanConns <- lanConn // 连接放入待命队列
-			it.lanConnsLock.Unlock()
-		}
-	}()
-
 	// 处理应用连接
 	go func() {
 		it.log.Info("start application port:", it.openAddress)
@@ -112,67 +123,257 @@ func StartRelayServer(
 			}
 			it.log.Debug("get a client connection", clientConn.LocalAddr().String(), "<-", clientConn.RemoteAddr().String())
 			// 处理客户端连接
-			it.handlClientConn(clientConn)
+			go it.handlClientConn(clientConn)
 		}
 	}()
 
 	return it
 }
 
+// 添加一个LAN绑定，listen为false时（单端口模式）不监听转发端口
+func (it *RelayServer) addMember(clientName string, weight int, listen bool, keyed bool) *relayMember {
+	member := startRelayMember(clientName, weight, it.relayPorts, it.guard, listen, keyed, it.log.With("client", clientName))
+	if member == nil {
+		return nil
+	}
+	it.membersLock.Lock()
+	defer it.membersLock.Unlock()
+	it.members = append(it.members, member)
+	return member
+}
+
+// 移除一个LAN绑定，返回剩余的成员数
+func (it *RelayServer) removeMember(member *relayMember) int {
+	it.membersLock.Lock()
+	defer it.membersLock.Unlock()
+	for i, m := range it.members {
+		if m == member {
+			it.members = append(it.members[:i], it.members[i+1:]...)
+			break
+		}
+	}
+	member.Close()
+	return len(it.members)
+}
+
+// 按客户端标识查找成员
+func (it *RelayServer) getMember(clientName string) *relayMember {
+	it.membersLock.Lock()
+	defer it.membersLock.Unlock()
+	for _, member := range it.members {
+		if member.clientName == clientName {
+			return member
+		}
+	}
+	return nil
+}
+
+// 按负载策略排列应用可用的候选成员，首个为优先选择
+func (it *RelayServer) pickMembers() []*relayMember {
+	it.membersLock.Lock()
+	defer it.membersLock.Unlock()
+
+	// 应用可用的成员
+	availableMembers := make([]*relayMember, 0, len(it.members))
+	for _, member := range it.members {
+		if member.isAvailable() {
+			availableMembers = append(availableMembers, member)
+		}
+	}
+	count := len(availableMembers)
+	if count == 0 {
+		return nil
+	}
+	members := make([]*relayMember, 0, count)
+
+	switch it.balancePolicy {
+	case BalancePolicyLeastConn:
+		members = append(members, availableMembers...)
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].active() < members[j].active()
+		})
+	case BalancePolicyWeighted:
+		// 平滑加权轮询
+		total := 0
+		var best *relayMember
+		for _, member := range availableMembers {
+			weight := member.getSettings().weight
+			member.currentWeight += weight
+			total += weight
+			if best == nil || member.currentWeight > best.currentWeight {
+				best = member
+			}
+		}
+		best.currentWeight -= total
+		members = append(members, best)
+		for _, member := range availableMembers {
+			if member != best {
+				members = append(members, member)
+			}
+		}
+	default:
+		it.nextMember = (it.nextMember + 1) % count
+		members = append(members, availableMembers[it.nextMember:]...)
+		members = append(members, availableMembers[:it.nextMember]...)
+	}
+	return members
+}
+
+// 秘密绑定的密钥是否一致
+func (it *RelayServer) matchSecret(secretKey string) bool {
+	if it.secret == nil {
+		return secretKey == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(it.secret.UserKey), []byte(secretKey)) == 1
+}
+
+// 处理CLIENT对秘密绑定的访问
+func (it *RelayServer) handleVisitConn(visitConn net.Conn) {
+	it.log.Debug("get a visit connection", visitConn.LocalAddr().String(), "<-", visitConn.RemoteAddr().String())
+	// 验证CLIENT持有密钥
+	if err := it.secret.WrHandshake(visitConn, config.WaitTimeout); err != nil {
+		it.log.Debug("visit handshake error:", err.Error())
+		if errors.Is(err, core.ErrHandshake) {
+			it.guard.fail(visitConn.RemoteAddr())
+		}
+		visitConn.Close()
+		return
+	}
+	it.handlClientConn(visitConn)
+}
+
 // 处理客户端的应用请求
 func (it *RelayServer) handlClientConn(clientConn net.Conn) {
-	lanConn, err := it.takeRelayConn()
+	// 加密时先验证CLIENT，未通过的连接不占用LAN的转发连接
+	if proofKey := it.proofKey(); proofKey != "" {
+		if err := core.MakeProofHandshaker(proofKey).WrHandshake(clientConn, config.WaitTimeout); err != nil {
+			it.log.Debug("client proof error:", err.Error(), "<-", clientConn.RemoteAddr().String())
+			clientConn.Close()
+			return
+		}
+	}
+	member, lanConn, err := it.takeRelayConn()
 	if err != nil {
 		it.log.Debug("take a relay connection error: " + err.Error())
 		clientConn.Close()
 		return
 	}
 	// 转发
-	go it.relay(clientConn, lanConn)
+	it.relay(clientConn, lanConn, member)
+}
+
+// 开放端口的CLIENT证明密钥（绑定时检查各成员一致），为空时不验证CLIENT
+func (it *RelayServer) proofKey() string {
+	it.membersLock.Lock()
+	defer it.membersLock.Unlock()
+	for _, member := range it.members {
+		return member.getSettings().proofKey
+	}
+	return ""
+}
+
+// 证明密钥是否与其他客户端的成员一致
+func (it *RelayServer) matchProofKey(clientName string, proofKey string) bool {
+	it.membersLock.Lock()
+	defer it.membersLock.Unlock()
+	for _, member := range it.members {
+		if member.clientName != clientName && member.getSettings().proofKey != proofKey {
+			return false
+		}
+	}
+	return true
+}
+
+// 成员提供的加密套件与其他成员不同时警告，CLIENT与部分成员可能协商失败
+func (it *RelayServer) checkCipherSuites(member *relayMember) {
+	it.membersLock.Lock()
+	defer it.membersLock.Unlock()
+	same := func(suites1, suites2 []string) bool {
+		if len(suites1) != len(suites2) {
+			return false
+		}
+		for _, suite := range suites1 {
+			if !slices.Contains(suites2, suite) {
+				return false
+			}
+		}
+		return true
+	}
+	settings := member.getSettings()
+	for _, other := range it.members {
+		otherSettings := other.getSettings()
+		if other != member && otherSettings.encrypted && settings.encrypted && !same(otherSettings.cipherSuites, settings.cipherSuites) {
+			it.log.Warn("client", member.clientName, "offers cipher suites", "["+strings.Join(settings.cipherSuites, ",")+"]",
+				"different from client", other.clientName, "["+strings.Join(otherSettings.cipherSuites, ",")+"]")
+			return
+		}
+	}
 }
 
-func (it *RelayServer) takeRelayConn() (net.Conn, error) {
+func (it *RelayServer) takeRelayConn() (*relayMember, net.Conn, error) {
 	startTime := time.Now()
 	// 获得现有或等待连接
 	for {
 
-		// 无连接则等待
-		aliveCount := len(it.lanConns)
-		if aliveCount == 0 {
-			// 等待连接超时
-			if time.Since(startTime) >= time.Duration(config.WaitTimeout) {
-				return nil, fmt.Errorf("wait relay connection timeout")
-			}
-			time.Sleep(10 * time.Millisecond)
-			continue
+		// 无可用的应用，快速拒绝
+		members := it.pickMembers()
+		if len(members) == 0 {
+			return nil, nil, fmt.Errorf("no available application")
 		}
 
-		// 获得lan端的连接
-		it.lanConnsLock.Lock()
-		lanConn := <-it.lanConns
-		it.lanConnsLock.Unlock()
-
-		// 通信前握手
-		err := it.handshaker.WrHandshake(lanConn, config.WaitTimeout)
-		if err != nil {
-			lanConn.Close()
-			it.log.Debug("handshaker error:", err.Error())
-			continue
+		// 按策略依次尝试各个成员
+		for _, member := range members {
+			lanConn := member.pollRelayConn()
+			if lanConn != nil {
+				return member, lanConn, nil
+			}
 		}
 
-		// 返回可用连接
-		return lanConn, nil
+		// 等待连接超时
+		if time.Since(startTime) >= time.Duration(config.WaitTimeout)*time.Second {
+			return nil, nil, fmt.Errorf("wait relay connection timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
 
-func (it *RelayServer) relay(clientConn, lanConn net.Conn) {
+func (it *RelayServer) relay(clientConn, lanConn net.Conn, member *relayMember) {
+	settings := member.getSettings()
+	record := &logger.AccessRecord{
+		SessionID:     uuid.New().String(),
+		OpenPort:      it.openAddress,
+		ClientAddress: clientConn.RemoteAddr().String(),
+		LanAddress:    lanConn.RemoteAddr().String(),
+		StartTime:     time.Now(),
+		Encrypted:     settings.encrypted,
+	}
+	log := it.log.With("session", record.SessionID)
+	member.addActive(1)
+	it.sessions.Put(clientConn, true)
 	defer func() {
+		it.sessions.Delete(clientConn)
+		member.addActive(-1)
 		clientConn.Close()
 		lanConn.Close()
-		it.log.Debug("break", clientConn.RemoteAddr().String(), "</>", lanConn.RemoteAddr().String())
+		log.Debug("break", clientConn.RemoteAddr().String(), "</>", lanConn.RemoteAddr().String())
 	}()
 
 	//  转发
-	it.log.Debug("relay", clientConn.RemoteAddr().String(), "<->", lanConn.RemoteAddr().String())
-	nets.Relay(lanConn, clientConn, it.relayIoTimeout, nil)
+	log.Debug("relay", clientConn.RemoteAddr().String(), "<->", lanConn.RemoteAddr().String(), "-", member.clientName)
+	stats := nets.Relay(lanConn, clientConn, it.relayIoTimeout, nil, nil)
+
+	// 访问记录
+	record.BytesFromClient = stats.Bytes21
+	record.BytesToClient = stats.Bytes12
+	record.CloseReason = stats.CloseReason("lan", "client")
+	it.access(record)
+}
+
+// 输出访问记录
+func (it *RelayServer) access(record *logger.AccessRecord) {
+	record.EndTime = time.Now()
+	it.log.Access(record)
+	if it.onSession != nil {
+		it.onSession(record)
+	}
 }
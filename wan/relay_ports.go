@@ -0,0 +1,98 @@
+package wan
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 转发端口的监听范围及对外公布的地址（WAN在NAT或容器中时，外部端口与监听端口不同）
+type relayPorts struct {
+	// 监听的IP，跟绑定端口的IP一致
+	host string
+	// 端口范围，均为0时为任意端口
+	min, max int
+	// 对外公布的主机，为空时LAN使用WAN的地址
+	advertiseHost string
+	// 对外公布的起始端口（对应min），0为端口不变
+	advertisePort int
+	// 下一个尝试的端口
+	next int
+	lock sync.Locker
+}
+
+// 解析端口范围（如 "40000-40100"）及公布地址（如 "1.1.1.1"、"1.1.1.1:50000" 或 ":50000"）
+func parseRelayPorts(host string, portRange string, advertise string) (*relayPorts, error) {
+	it := &relayPorts{host: host, lock: &sync.Mutex{}}
+
+	if portRange != "" {
+		from, to, found := strings.Cut(portRange, "-")
+		if !found {
+			to = from
+		}
+		var err error
+		if it.min, err = strconv.Atoi(strings.TrimSpace(from)); err != nil {
+			return nil, fmt.Errorf("invalid relay port range %s", portRange)
+		}
+		if it.max, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+			return nil, fmt.Errorf("invalid relay port range %s", portRange)
+		}
+		if it.min < 1 || it.max > 65535 || it.min > it.max {
+			return nil, fmt.Errorf("invalid relay port range %s", portRange)
+		}
+	}
+
+	if advertise != "" {
+		// 只有主机时端口不变
+		advertiseHost, advertisePort, err := net.SplitHostPort(advertise)
+		if err != nil {
+			advertiseHost, advertisePort = advertise, ""
+		}
+		it.advertiseHost = advertiseHost
+		if advertisePort != "" {
+			if it.min == 0 {
+				return nil, fmt.Errorf("the advertised relay port requires a relay port range")
+			}
+			if it.advertisePort, err = strconv.Atoi(advertisePort); err != nil || it.advertisePort < 1 || it.advertisePort+it.max-it.min > 65535 {
+				return nil, fmt.Errorf("invalid advertised relay port %s", advertisePort)
+			}
+		}
+	}
+	return it, nil
+}
+
+// 监听一个转发端口，有范围时依次尝试范围内的空闲端口
+func (it *relayPorts) listen() (net.Listener, error) {
+	if it.min == 0 {
+		return net.Listen("tcp", net.JoinHostPort(it.host, "0"))
+	}
+
+	it.lock.Lock()
+	start := it.next
+	it.next = (it.next + 1) % (it.max - it.min + 1)
+	it.lock.Unlock()
+
+	var lastErr error
+	for i := 0; i <= it.max-it.min; i++ {
+		port := it.min + (start+i)%(it.max-it.min+1)
+		listener, err := net.Listen("tcp", net.JoinHostPort(it.host, strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no free relay port in %d-%d: %v", it.min, it.max, lastErr)
+}
+
+// 转发端口对外公布的地址，未设置时为空（LAN连接WAN地址上的转发端口）
+func (it *relayPorts) advertise(port int) string {
+	if it.advertiseHost == "" && it.advertisePort == 0 {
+		return ""
+	}
+	if it.advertisePort != 0 {
+		port = it.advertisePort + port - it.min
+	}
+	return net.JoinHostPort(it.advertiseHost, strconv.Itoa(port))
+}
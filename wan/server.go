@@ -1,133 +1,729 @@
-package wan
-
-import (
-	"crypto/tls"
-	"net"
-	"tcp-tunnel/config"
-	"tcp-tunnel/core"
-	"tcp-tunnel/logger"
-)
-
-type BindServer struct {
-	bindAddress   *net.TCPAddr
-	ioTimeout     int
-	bindHandshake *core.Handshaker
-	log           *logger.Logger
-}
-
-func StartBindServer(
-	bindAddress *net.TCPAddr,
-	ioTimeout int,
-	bindHandshakeKey string,
-	log *logger.Logger,
-	tlsCertificate string,
-	tlsPrivateKey string,
-) {
-
-	// 实例化
-	it := &BindServer{
-		bindAddress:   bindAddress,
-		ioTimeout:     ioTimeout,
-		bindHandshake: core.MakeHandshaker(bindHandshakeKey),
-		log:           log,
-	}
-
-	if tlsCertificate != "" {
-		// 证书配置
-		cert, err := tls.LoadX509KeyPair(tlsCertificate, tlsPrivateKey)
-		if err != nil {
-			it.log.Error(err, "load x509 key pair error")
-			return
-		}
-		// TLSs监听服务端口
-		server, err := tls.Listen("tcp", it.bindAddress.AddrPort().String(), &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
-		if err != nil {
-			it.log.Error(err, "listen tls bind server error")
-			return
-		}
-		it.log.Info("start tls bind server at", it.bindAddress.AddrPort().String())
-		it.accept(server)
-	} else {
-		// TCP监听服务端口
-		server, err := net.Listen("tcp", it.bindAddress.AddrPort().String())
-		if err != nil {
-			it.log.Error(err, "listen tcp bind server error")
-			return
-		}
-		it.log.Info("start tcp bind server at", it.bindAddress.AddrPort().String())
-		it.accept(server)
-	}
-}
-
-func (it *BindServer) accept(server net.Listener) {
-	defer server.Close()
-	// 处理请求
-	for {
-		bindConn, err := server.Accept()
-		if err != nil {
-			it.log.Debug("accept bind connection error:", err.Error())
-			break
-		}
-		it.log.Debug("get a bind connection", bindConn.LocalAddr().String(), "<-", bindConn.RemoteAddr().String())
-		go it.handleBindConn(bindConn)
-	}
-}
-
-// 处理请求
-func (it *BindServer) handleBindConn(bindConn net.Conn) {
-	defer bindConn.Close()
-
-	// 通信前握手
-	err := it.bindHandshake.WrHandshake(bindConn, config.WaitTimeout)
-	if err != nil {
-		it.log.Debug("bind handshaker error:", err.Error())
-		return
-	}
-
-	// 读取bind命令
-	bindRequest := &core.BindRequest{}
-	if err := core.ReadJson2Object(bindConn, &bindRequest); err != nil {
-		it.log.Debug("read bind request error:", err.Error())
-		return
-	}
-
-	// 启动转发服务
-	relayServer := StartRelayServer(it.bindAddress.IP.String(), bindRequest.OpenPort, it.ioTimeout, it.log)
-	if relayServer == nil {
-		return
-	}
-	defer relayServer.Close()
-
-	// 转发服务的地址
-	relayAddr, err := net.ResolveTCPAddr("tcp", relayServer.relayListener.Addr().String())
-	if err != nil {
-		it.log.Debug("resolve relay address error:", err.Error())
-		return
-	}
-
-	// 响应绑定连接
-	err = core.WriteObject2Json(bindConn, &core.BindResponse{
-		Response:     core.Response{Message: "success"},
-		ClientName:   bindRequest.ClientName,
-		RelayPort:    relayAddr.Port, // 这里传端口是为了避免回传内网地址
-		HandshakeKey: relayServer.handshaker.UserKey,
-	})
-	if err != nil {
-		it.log.Debug("response bind connection error:", err.Error())
-		return
-	}
-
-	// 长连接，断开则关闭代理
-	func() {
-		defer bindConn.Close()
-		buff := make([]byte, 64)
-		for {
-			size, err := bindConn.Read(buff)
-			if err != nil {
-				it.log.Debug("break bind:", err.Error())
-				break
-			}
-			bindConn.Write(buff[:size])
-		}
-	}()
-}
+package wan
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"tcp-tunnel/config"
+	"tcp-tunnel/core"
+	"tcp-tunnel/logger"
+	nets "tcp-tunnel/net"
+	"time"
+)
+
+// Server WAN服务，接受LAN的绑定并开放端口
+type Server struct {
+	bindAddress *net.TCPAddr
+	// 转发端口的范围及公布地址
+	relayPorts *relayPorts
+	// 绑定端口使用KCP
+	kcp bool
+	// 单端口模式：支持的LAN经绑定端口建立转发连接，不监听转发端口
+	singlePort    bool
+	ioTimeout     int
+	gracePeriod   int
+	balancePolicy string
+	bindHandshake *core.Handshaker
+	// 访问秘密绑定的握手（为空时访问者使用握手密钥）
+	visitHandshake *core.Handshaker
+	// 绑定令牌的密钥（为空时不验证令牌）
+	tokenKey *core.TokenKey
+	// 握手失败过多的IP的封禁（为空时不封禁）
+	guard  *guard
+	log    *logger.Logger
+	events Events
+	// TLS证书及私钥文件
+	tlsCertificate string
+	tlsPrivateKey  string
+	// WebSocket的监听地址及路径
+	webSocketAddress string
+	webSocketPath    string
+	webSocketServer  *http.Server
+	// 开放端口 -> 转发服务
+	relayServers *core.SyncMap
+	bindLock     sync.Locker
+	// 上次分配的KCP转发流标识（bindLock保护）
+	lastStreamID int32
+	// 绑定端口监听器及当前的绑定连接
+	listener  net.Listener
+	bindConns *core.SyncMap
+	// 关闭信号
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer 按配置创建WAN服务，调用Run开始服务
+func NewServer(config Config) (*Server, error) {
+	bindAddr, relayPorts, tokenKey, err := config.check()
+	if err != nil {
+		return nil, err
+	}
+	log := config.Log
+	if log == nil {
+		log = logger.NewLogger("WAN", logger.LevelInfo, nil)
+	}
+
+	var visitHandshake *core.Handshaker
+	if config.VisitKey != "" {
+		visitHandshake = core.MakeHandshaker(config.VisitKey, false)
+	}
+
+	// 实例化
+	return &Server{
+		bindAddress:      bindAddr,
+		relayPorts:       relayPorts,
+		kcp:              nets.IsKcpAddress(config.BindAddress),
+		singlePort:       config.SinglePort,
+		ioTimeout:        config.IoTimeout,
+		gracePeriod:      config.GracePeriod,
+		balancePolicy:    config.BalancePolicy,
+		bindHandshake:    core.MakeHandshaker(config.HandshakeKey, config.LegacyHandshake),
+		visitHandshake:   visitHandshake,
+		tokenKey:         tokenKey,
+		guard:            newGuard(config.BanFailures, config.BanTime, config.BanFile, log),
+		log:              log,
+		events:           config.Events,
+		tlsCertificate:   config.TlsCertificate,
+		tlsPrivateKey:    config.TlsPrivateKey,
+		webSocketAddress: config.WebSocketAddress,
+		webSocketPath:    config.WebSocketPath,
+		relayServers:     core.MakeSyncMap(16),
+		bindLock:         &sync.Mutex{},
+		bindConns:        core.MakeSyncMap(16),
+		done:             make(chan struct{}),
+	}, nil
+}
+
+// Run 监听绑定端口并处理绑定请求，直到ctx取消或调用Close
+// 返回 ctx.Err()、core.ErrClosed 或监听错误
+func (it *Server) Run(ctx context.Context) error {
+	listener, err := it.listen()
+	if err != nil {
+		return err
+	}
+	if it.bindHandshake.UserKey == "" && it.tlsCertificate == "" {
+		it.log.Warn("no handshake key or tls, the bind and relay connections are not authenticated")
+	}
+
+	// WebSocket服务
+	var webSocketServer *http.Server
+	var webSocketListener net.Listener
+	if it.webSocketAddress != "" {
+		webSocketServer, webSocketListener, err = it.listenWebSocket()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	// 关闭后不再服务
+	it.bindLock.Lock()
+	if it.isClosed() {
+		it.bindLock.Unlock()
+		listener.Close()
+		if webSocketListener != nil {
+			webSocketListener.Close()
+		}
+		return core.ErrClosed
+	}
+	it.listener = listener
+	it.webSocketServer = webSocketServer
+	it.bindLock.Unlock()
+
+	if webSocketServer != nil {
+		go func() {
+			if err := webSocketServer.Serve(webSocketListener); err != nil && !it.isClosed() {
+				it.log.Error(err, "websocket server error")
+			}
+		}()
+	}
+
+	// 重新读取被修改的封禁文件
+	go it.guard.loopReload(it.done)
+
+	// ctx取消时关闭
+	go func() {
+		select {
+		case <-ctx.Done():
+			it.Close()
+		case <-it.done:
+		}
+	}()
+
+	if err := it.accept(listener); err != nil {
+		it.Close()
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return core.ErrClosed
+}
+
+// Close 关闭绑定端口、所有开放端口及正在转发的连接
+func (it *Server) Close() error {
+	it.closeOnce.Do(func() {
+		close(it.done)
+
+		it.bindLock.Lock()
+		if it.listener != nil {
+			it.listener.Close()
+		}
+		if it.webSocketServer != nil {
+			it.webSocketServer.Close()
+		}
+		it.relayServers.Range(func(key, value interface{}) bool {
+			relayServer := value.(*RelayServer)
+			// 复制成员后再通知，回调不持有成员锁
+			relayServer.membersLock.Lock()
+			members := append([]*relayMember{}, relayServer.members...)
+			relayServer.membersLock.Unlock()
+			for _, member := range members {
+				if it.events.OnUnbind != nil {
+					it.events.OnUnbind(member.clientName, relayServer.openAddress)
+				}
+			}
+			relayServer.Close()
+			return true
+		})
+		it.relayServers = core.MakeSyncMap(16)
+		it.bindLock.Unlock()
+
+		// 断开绑定连接
+		it.bindConns.Range(func(key, value interface{}) bool {
+			key.(net.Conn).Close()
+			return true
+		})
+	})
+	return nil
+}
+
+// Bans 封禁中的IP
+func (it *Server) Bans() []Ban {
+	return it.guard.list()
+}
+
+// Unban 解封IP，返回是否存在封禁记录
+func (it *Server) Unban(ip string) bool {
+	return it.guard.unban(ip)
+}
+
+func (it *Server) isClosed() bool {
+	select {
+	case <-it.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// 监听绑定端口
+func (it *Server) listen() (net.Listener, error) {
+	address := it.bindAddress.AddrPort().String()
+	if it.kcp {
+		server, err := nets.ListenKcp(address)
+		if err != nil {
+			it.log.Error(err, "listen kcp bind server error")
+			return nil, &core.ListenError{Address: address, Err: err}
+		}
+		it.log.Info("start kcp bind server at", address)
+		return server, nil
+	}
+	if it.tlsCertificate != "" {
+		// 证书配置
+		cert, err := tls.LoadX509KeyPair(it.tlsCertificate, it.tlsPrivateKey)
+		if err != nil {
+			it.log.Error(err, "load x509 key pair error")
+			return nil, err
+		}
+		// TLSs监听服务端口
+		server, err := tls.Listen("tcp", address, &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+		if err != nil {
+			it.log.Error(err, "listen tls bind server error")
+			return nil, &core.ListenError{Address: address, Err: err}
+		}
+		it.log.Info("start tls bind server at", address)
+		return server, nil
+	}
+	// TCP监听服务端口
+	server, err := net.Listen("tcp", address)
+	if err != nil {
+		it.log.Error(err, "listen tcp bind server error")
+		return nil, &core.ListenError{Address: address, Err: err}
+	}
+	it.log.Info("start tcp bind server at", address)
+	return server, nil
+}
+
+// 接受绑定连接，关闭后返回nil
+func (it *Server) accept(server net.Listener) error {
+	defer server.Close()
+	// 处理请求
+	for {
+		bindConn, err := server.Accept()
+		if err != nil {
+			it.log.Debug("accept bind connection error:", err.Error())
+			if it.isClosed() {
+				return nil
+			}
+			return err
+		}
+		if !it.guard.allow(bindConn.RemoteAddr()) {
+			it.log.Debug("refuse banned connection", bindConn.RemoteAddr().String())
+			bindConn.Close()
+			continue
+		}
+		if it.kcp {
+			go it.handleKcpStream(bindConn)
+			continue
+		}
+		it.log.Debug("get a bind connection", bindConn.LocalAddr().String(), "<-", bindConn.RemoteAddr().String())
+		go it.handleBindConn(bindConn)
+	}
+}
+
+// KCP会话上的流，按开头的标识分为绑定连接及转发连接
+func (it *Server) handleKcpStream(conn net.Conn) {
+	streamID, err := nets.ReadStreamID(conn, time.Duration(config.WaitTimeout)*time.Second)
+	if err != nil {
+		it.log.Debug("read kcp stream id error:", err.Error())
+		conn.Close()
+		return
+	}
+	if streamID == 0 {
+		it.log.Debug("get a kcp bind connection", conn.LocalAddr().String(), "<-", conn.RemoteAddr().String())
+		it.handleBindConn(conn)
+		return
+	}
+	member := it.findMember(func(member *relayMember) bool {
+		return member.getStreamID() == int32(streamID)
+	})
+	if member == nil {
+		it.log.Debug("kcp relay stream not found", strconv.Itoa(streamID), "<-", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	member.putRelayConn(conn)
+}
+
+// 处理请求
+func (it *Server) handleBindConn(bindConn net.Conn) {
+	it.bindConns.Put(bindConn, true)
+	defer it.bindConns.Delete(bindConn)
+	// 转发连接交给成员，不关闭
+	relay := false
+	defer func() {
+		if !relay {
+			bindConn.Close()
+		}
+	}()
+
+	// 通信前握手，之后的请求及响应经控制连接（加密）
+	handshakers := []*core.Handshaker{it.bindHandshake}
+	if it.visitHandshake != nil {
+		handshakers = append(handshakers, it.visitHandshake)
+	}
+	handshaker, controlConn, err := core.WrControlHandshakeAny(bindConn, config.WaitTimeout, handshakers...)
+	if err != nil {
+		it.log.Debug("bind handshaker error:", err.Error())
+		if errors.Is(err, core.ErrHandshake) {
+			it.guard.fail(bindConn.RemoteAddr())
+		}
+		return
+	}
+	it.guard.succeed(bindConn.RemoteAddr())
+
+	// 读取命令
+	line, err := core.ReadJsonLine(controlConn)
+	if err != nil {
+		it.log.Debug("read bind request error:", err.Error())
+		return
+	}
+	request := &core.Reqeust{}
+	if err := json.Unmarshal(line, request); err != nil {
+		it.log.Debug("read bind request error:", err.Error())
+		return
+	}
+
+	// 访问密钥只能访问秘密绑定
+	if handshaker == it.visitHandshake && request.Action != "visit" {
+		it.log.Debug("refuse", request.Action, "request with the visit key <-", bindConn.RemoteAddr().String())
+		return
+	}
+
+	// CLIENT访问秘密绑定
+	if request.Action == "visit" {
+		visitRequest := &core.VisitRequest{}
+		if err := json.Unmarshal(line, visitRequest); err != nil {
+			it.log.Debug("read visit request error:", err.Error())
+			return
+		}
+		it.handleVisitConn(controlConn, visitRequest)
+		return
+	}
+
+	// 单端口模式下LAN的转发连接
+	if request.Action == "relay" && it.singlePort {
+		relayRequest := &core.RelayRequest{}
+		if err := json.Unmarshal(line, relayRequest); err != nil {
+			it.log.Debug("read relay request error:", err.Error())
+			return
+		}
+		member := it.findMember(func(member *relayMember) bool {
+			return member.bindingID == relayRequest.BindingID
+		})
+		if member == nil {
+			it.log.Debug("relay binding not found", relayRequest.BindingID, "<-", bindConn.RemoteAddr().String())
+			return
+		}
+		relay = true
+		member.putRelayConn(bindConn)
+		return
+	}
+
+	// 读取bind命令
+	bindRequest := &core.BindRequest{}
+	if err := json.Unmarshal(line, bindRequest); err != nil {
+		it.log.Debug("read bind request error:", err.Error())
+		return
+	}
+	// 控制连接不保密（旧版本的握手，或握手密钥为空，且未使用TLS）时证明密钥可能已泄露，不使用；
+	// 也不发送转发握手的密钥，旧版本的握手为兼容仍然发送
+	secure := controlConn.Encrypted() || it.tlsCertificate != ""
+	if !secure {
+		bindRequest.ProofKey = ""
+	}
+	// 秘密绑定不开放端口，以名称区分
+	if bindRequest.Secret != "" {
+		bindRequest.OpenPort = core.SecretBindingPrefix + bindRequest.OpenPort
+	}
+
+	// 验证绑定令牌
+	claims, err := it.checkToken(bindRequest)
+	if err != nil {
+		it.log.Warn("refuse binding", bindRequest.OpenPort, "<-", bindConn.RemoteAddr().String(), "-", err.Error())
+		if errors.Is(err, core.ErrToken) {
+			it.guard.fail(bindConn.RemoteAddr())
+		}
+		core.WriteObject2Json(controlConn, &core.BindResponse{
+			Response:   core.Response{Message: err.Error()},
+			ClientName: bindRequest.ClientName,
+		})
+		return
+	}
+	// 令牌过期时断开绑定
+	if claims != nil && claims.ExpiresAt != 0 {
+		expireTimer := time.AfterFunc(time.Until(time.Unix(claims.ExpiresAt, 0)), func() {
+			it.log.Info("token expired, unbind", bindRequest.OpenPort, "-", bindRequest.ClientName)
+			bindConn.Close()
+		})
+		defer expireTimer.Stop()
+	}
+
+	// 启动或接管转发服务
+	// 令牌指定了客户端标识时，持有令牌即可接管
+	named := claims != nil && claims.ClientName != ""
+	relayServer, member, err := it.attachRelayServer(bindRequest, bindConn, secure || handshaker.Legacy, named)
+	if err != nil {
+		it.log.Error(err, "bind open port error", bindRequest.OpenPort)
+		core.WriteObject2Json(controlConn, &core.BindResponse{
+			Response:   core.Response{Message: err.Error()},
+			ClientName: bindRequest.ClientName,
+		})
+		return
+	}
+	defer it.detachRelayServer(relayServer, member, bindConn)
+
+	// 响应绑定连接
+	bindResponse := &core.BindResponse{
+		Response:     core.Response{Message: "success"},
+		ClientName:   bindRequest.ClientName,
+		RelayPort:    member.getRelayPort(), // 这里传端口是为了避免回传内网地址
+		HandshakeKey: member.getSettings().handshaker.UserKey,
+		// 转发连接的握手版本（旧版本的LAN不带版本时为版本1）
+		HandshakeVersion: core.HandshakeVersion,
+		TakeoverKey:      member.takeoverKey,
+	}
+	// KCP绑定时为会话上转发流的标识，监听了转发端口（非单端口模式）时公布转发地址
+	if streamID := member.getStreamID(); streamID != 0 && nets.IsKcpStream(bindConn) {
+		bindResponse.RelayPort = int(streamID)
+	} else if relayPort := member.getRelayPort(); relayPort != 0 {
+		bindResponse.RelayAddress = it.relayPorts.advertise(relayPort)
+	}
+	if it.useSinglePort(bindRequest) {
+		bindResponse.BindingID = member.bindingID
+	}
+	err = core.WriteObject2Json(controlConn, bindResponse)
+	if err != nil {
+		it.log.Debug("response bind connection error:", err.Error())
+		return
+	}
+
+	// 长连接，断开则关闭代理
+	func() {
+		defer bindConn.Close()
+		for {
+			statusRequest := &core.StatusRequest{}
+			err := core.ReadJson2Object(controlConn, statusRequest)
+			if err != nil {
+				if core.IsJsonError(err) {
+					continue
+				}
+				it.log.Debug("break bind:", err.Error())
+				break
+			}
+			// 应用可用状态
+			if member.setAvailable(statusRequest.Available) {
+				it.log.Info("client", member.clientName, "application available:", strconv.FormatBool(statusRequest.Available), "-", bindRequest.OpenPort)
+			}
+			core.WriteObject2Json(controlConn, statusRequest)
+		}
+	}()
+}
+
+// 处理CLIENT对秘密绑定的访问，验证密钥后转发到LAN
+func (it *Server) handleVisitConn(visitConn *core.ControlConn, visitRequest *core.VisitRequest) {
+	var relayServer *RelayServer
+	if value, ok := it.relayServers.Get(core.SecretBindingPrefix + visitRequest.SecretName); ok {
+		relayServer = value.(*RelayServer)
+	}
+	if relayServer == nil || relayServer.secret == nil {
+		it.log.Debug("visit unknow secret binding", visitRequest.SecretName, "<-", visitConn.RemoteAddr().String())
+		core.WriteObject2Json(visitConn, &core.Response{Message: "unknow secret binding"})
+		return
+	}
+	if err := core.WriteObject2Json(visitConn, &core.Response{Message: "success"}); err != nil {
+		it.log.Debug("response visit connection error:", err.Error())
+		return
+	}
+	relayServer.handleVisitConn(visitConn.Conn)
+}
+
+// 绑定转发服务，相同客户端标识且带上接管密钥（或令牌指定了客户端标识，named）的重连将接管原有的绑定，
+// 不同的客户端加入同一开放端口分担负载，
+// keyed为false时（控制连接不保密）成员的转发握手密钥为空，不能接管有密钥的成员
+func (it *Server) attachRelayServer(bindRequest *core.BindRequest, bindConn net.Conn, keyed bool, named bool) (*RelayServer, *relayMember, error) {
+	it.bindLock.Lock()
+	defer it.bindLock.Unlock()
+
+	if it.isClosed() {
+		return nil, nil, core.ErrClosed
+	}
+	// 网关模式不加密时开放端口即为无验证的代理
+	if bindRequest.Gateway && !bindRequest.Encrypted {
+		return nil, nil, fmt.Errorf("the gateway mode requires the relay encrypt key")
+	}
+
+	// 权重至少为1
+	if bindRequest.Weight < 1 {
+		bindRequest.Weight = 1
+	}
+	// KCP绑定的转发连接为会话上的流，不监听转发端口
+	kcpStream := !it.useSinglePort(bindRequest) && nets.IsKcpStream(bindConn)
+	listen := !it.useSinglePort(bindRequest) && !kcpStream
+
+	// 已存在的转发服务
+	if value, ok := it.relayServers.Get(bindRequest.OpenPort); ok {
+		relayServer := value.(*RelayServer)
+		// 秘密绑定的密钥须一致，避免被冒用
+		if !relayServer.matchSecret(bindRequest.Secret) {
+			return nil, nil, fmt.Errorf("secret not match")
+		}
+		// CLIENT的证明须与其他成员一致，避免一个成员关闭整个开放端口的验证
+		if !relayServer.matchProofKey(bindRequest.ClientName, bindRequest.ProofKey) {
+			return nil, nil, fmt.Errorf("the CLIENT proof (encrypt key or legacy handshake) differs from the other clients on the open port")
+		}
+		member := relayServer.getMember(bindRequest.ClientName)
+		if member == nil {
+			// 加入开放端口
+			member = relayServer.addMember(bindRequest.ClientName, bindRequest.Weight, listen, keyed)
+			if member == nil {
+				return nil, nil, fmt.Errorf("start relay member error")
+			}
+			if kcpStream && !it.allocStreamID(member) {
+				relayServer.removeMember(member)
+				return nil, nil, fmt.Errorf("no kcp relay stream id available")
+			}
+			member.applyBindRequest(bindRequest)
+			it.log.Info("client", bindRequest.ClientName, "join open port", bindRequest.OpenPort)
+		} else {
+			// 只有原来的LAN（持有接管密钥）或令牌指定的客户端可以接管，避免客户端标识被冒用
+			if !named && !member.matchTakeoverKey(bindRequest.TakeoverKey) {
+				return nil, nil, fmt.Errorf("client %s is already bound to the open port", bindRequest.ClientName)
+			}
+			// 转发握手的密钥不能经不保密的控制连接发送
+			if !keyed && member.getSettings().handshaker.UserKey != "" {
+				return nil, nil, fmt.Errorf("the binding can only be taken over with the handshake key or tls")
+			}
+			// 停止宽限计时
+			if member.graceTimer != nil {
+				member.graceTimer.Stop()
+				member.graceTimer = nil
+			}
+			// 断开旧的绑定连接
+			if member.bindConn != nil {
+				member.bindConn.Close()
+			}
+			// 不支持单端口模式的LAN接管时需要转发端口
+			if listen && member.listen() != nil {
+				return nil, nil, fmt.Errorf("start relay member error")
+			}
+			if kcpStream && member.getStreamID() == 0 && !it.allocStreamID(member) {
+				return nil, nil, fmt.Errorf("no kcp relay stream id available")
+			}
+			member.applyBindRequest(bindRequest)
+			member.setAvailable(true) // 不可用时由LAN重新通知
+			it.log.Info("client", bindRequest.ClientName, "take over open port", bindRequest.OpenPort)
+		}
+		member.bindConn = bindConn
+		relayServer.checkCipherSuites(member)
+		it.onBind(member.clientName, bindRequest.OpenPort)
+		return relayServer, member, nil
+	}
+
+	// 启动转发服务
+	relayServer := StartRelayServer(it.relayPorts, bindRequest.OpenPort, bindRequest.Secret, it.bindHandshake.Legacy, it.ioTimeout, it.balancePolicy, it.log, it.events.OnSession)
+	if relayServer == nil {
+		return nil, nil, fmt.Errorf("start relay server error")
+	}
+	relayServer.guard = it.guard
+	member := relayServer.addMember(bindRequest.ClientName, bindRequest.Weight, listen, keyed)
+	if member == nil || (kcpStream && !it.allocStreamID(member)) {
+		relayServer.Close()
+		return nil, nil, fmt.Errorf("start relay member error")
+	}
+	member.applyBindRequest(bindRequest)
+	member.bindConn = bindConn
+	it.relayServers.Put(bindRequest.OpenPort, relayServer)
+	it.onBind(member.clientName, bindRequest.OpenPort)
+	return relayServer, member, nil
+}
+
+// 解除绑定，宽限期内保留成员等待客户端重连
+func (it *Server) detachRelayServer(relayServer *RelayServer, member *relayMember, bindConn net.Conn) {
+	it.bindLock.Lock()
+	defer it.bindLock.Unlock()
+
+	// 已被新的绑定连接接管
+	if member.bindConn != bindConn {
+		return
+	}
+	member.bindConn = nil
+
+	// 服务已关闭
+	if it.isClosed() {
+		return
+	}
+
+	// 无宽限期则立即移除
+	if it.gracePeriod <= 0 {
+		it.removeMember(relayServer, member)
+		return
+	}
+
+	it.log.Info("keep client", member.clientName, "on open port", relayServer.openAddress, "for", strconv.Itoa(it.gracePeriod), "seconds to wait reconnect")
+	// 宽限期内不可用，用户连接快速拒绝或转给其他成员
+	member.setAvailable(false)
+	member.graceTimer = time.AfterFunc(time.Duration(it.gracePeriod)*time.Second, func() {
+		it.bindLock.Lock()
+		defer it.bindLock.Unlock()
+		// 宽限期内已重连
+		if member.bindConn != nil || it.isClosed() {
+			return
+		}
+		it.log.Warn("grace period expired, remove client", member.clientName, "from open port", relayServer.openAddress)
+		it.removeMember(relayServer, member)
+	})
+}
+
+// 移除成员，无成员时关闭转发服务（调用方持有bindLock）
+func (it *Server) removeMember(relayServer *RelayServer, member *relayMember) {
+	member.graceTimer = nil
+	remain := relayServer.removeMember(member)
+	if it.events.OnUnbind != nil {
+		it.events.OnUnbind(member.clientName, relayServer.openAddress)
+	}
+	if remain > 0 {
+		return
+	}
+	it.log.Info("close open port", relayServer.openAddress)
+	relayServer.Close()
+	it.relayServers.Delete(relayServer.openAddress)
+}
+
+// 查找符合条件的成员
+func (it *Server) findMember(match func(member *relayMember) bool) *relayMember {
+	var found *relayMember
+	it.relayServers.Range(func(key, value interface{}) bool {
+		relayServer := value.(*RelayServer)
+		relayServer.membersLock.Lock()
+		defer relayServer.membersLock.Unlock()
+		for _, member := range relayServer.members {
+			if match(member) {
+				found = member
+				return false
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// 为KCP绑定的成员分配转发流的标识（1-65535，0为绑定连接），调用方持有bindLock
+func (it *Server) allocStreamID(member *relayMember) bool {
+	for i := 0; i < 0xffff; i++ {
+		it.lastStreamID = it.lastStreamID%0xffff + 1
+		streamID := it.lastStreamID
+		if it.findMember(func(member *relayMember) bool { return member.getStreamID() == streamID }) == nil {
+			atomic.StoreInt32(&member.streamID, streamID)
+			return true
+		}
+	}
+	return false
+}
+
+// 按转发端口查找成员
+func (it *Server) findMemberByPort(relayPort int) *relayMember {
+	return it.findMember(func(member *relayMember) bool {
+		return relayPort != 0 && member.getRelayPort() == relayPort
+	})
+}
+
+// 验证绑定令牌（未设置令牌密钥时不验证），返回令牌的内容
+func (it *Server) checkToken(bindRequest *core.BindRequest) (*core.TokenClaims, error) {
+	if it.tokenKey == nil {
+		return nil, nil
+	}
+	if bindRequest.Token == "" {
+		return nil, fmt.Errorf("%w: token required", core.ErrToken)
+	}
+	claims, err := core.VerifyToken(bindRequest.Token, it.tokenKey)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ClientName != "" && claims.ClientName != bindRequest.ClientName {
+		return nil, fmt.Errorf("the token is not for client %s", bindRequest.ClientName)
+	}
+	if !claims.AllowOpenPort(bindRequest.OpenPort) {
+		return nil, fmt.Errorf("the token does not allow open port %s", bindRequest.OpenPort)
+	}
+	return claims, nil
+}
+
+// 是否以单端口模式绑定（WAN开启且LAN支持）
+func (it *Server) useSinglePort(bindRequest *core.BindRequest) bool {
+	return it.singlePort && bindRequest.SinglePort
+}
+
+func (it *Server) onBind(clientName, openPort string) {
+	if it.events.OnBind != nil {
+		it.events.OnBind(clientName, openPort)
+	}
+}
@@ -0,0 +1,180 @@
+package wan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"tcp-tunnel/core"
+	"time"
+
+	"github.com/yymmiinngg/goargs"
+)
+
+// StartToken 签发或查看LAN的绑定令牌，生成Ed25519密钥对
+func StartToken(argsArr []string) {
+
+	template := `
+    Usage: {{COMMAND}} TOKEN {{OPTION}}
+
+	+ -k, --key           # Signing key: the HMAC secret or the Ed25519 private key of the
+	#                       WAN --token-key, when inspecting a token, the public key also
+	#                       verifies it
+	+ -n, --client-name   # Limit the token to the LAN with the client name (--client-name
+	#                       of LAN, the LAN uses it when not set)
+	+ -p, --ports         # Open ports allowed to bind, separated by commas, like
+	#                       "8080,9000-9100" or "secret:name" for a secret binding, or "*"
+	+ -e, --expire        # Expire after the duration, like "7d", "12h" or "30m" (Default:
+	#                       7d, 0 to never expire)
+	+ -i, --inspect       # Show the content of a token, and verify it with --key
+	? -g, --generate-key  # Generate an Ed25519 key pair, sign tokens with the private key,
+	#                       and give the public key to the WAN
+
+    ? -H, --help          # Show Help and Exit
+`
+
+	// 定义变量
+	var key string
+	var clientName string
+	var ports string
+	var expire string
+	var inspect string
+	var generateKey bool
+
+	// 编译模板
+	args, err := goargs.Compile(template)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	// 绑定变量
+	args.StringOption("-k", &key, "")
+	args.StringOption("-n", &clientName, "")
+	args.StringOption("-p", &ports, "")
+	args.StringOption("-e", &expire, "7d")
+	args.StringOption("-i", &inspect, "")
+	args.BoolOption("-g", &generateKey, false)
+
+	// 处理参数
+	err = args.Parse(argsArr, goargs.AllowUnknowOption)
+
+	// 显示帮助
+	if args.HasItem("-H", "--help") {
+		fmt.Println(args.Usage())
+		return
+	}
+
+	// 错误输出
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	// 生成密钥对
+	if generateKey {
+		privateKey, publicKey, err := core.GenerateTokenKeyPair()
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		fmt.Println("private key:", privateKey)
+		fmt.Println("public key :", publicKey)
+		return
+	}
+
+	// 查看令牌
+	if inspect != "" {
+		inspectToken(inspect, key)
+		return
+	}
+
+	// 签发令牌
+	if key == "" || ports == "" {
+		fmt.Println("The key and ports are mandatory to sign a token")
+		return
+	}
+	tokenKey, err := core.ParseTokenKey(key)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	duration, err := parseExpire(expire)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	claims := &core.TokenClaims{
+		ClientName: clientName,
+		IssuedAt:   time.Now().Unix(),
+	}
+	for _, port := range strings.Split(ports, ",") {
+		if strings.TrimSpace(port) != "" {
+			claims.OpenPorts = append(claims.OpenPorts, strings.TrimSpace(port))
+		}
+	}
+	if duration > 0 {
+		claims.ExpiresAt = time.Now().Add(duration).Unix()
+	}
+	token, err := core.SignToken(claims, tokenKey)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Println(token)
+}
+
+// 显示令牌的内容，key不为空时验证
+func inspectToken(token string, key string) {
+	alg, claims, err := core.DecodeToken(token)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	clientName := claims.ClientName
+	if clientName == "" {
+		clientName = "(any)"
+	}
+	expires := "never"
+	if claims.ExpiresAt != 0 {
+		expires = time.Unix(claims.ExpiresAt, 0).Local().Format(time.RFC3339)
+	}
+	fmt.Println("algorithm  :", alg)
+	fmt.Println("client name:", clientName)
+	fmt.Println("open ports :", strings.Join(claims.OpenPorts, ","))
+	fmt.Println("issued at  :", time.Unix(claims.IssuedAt, 0).Local().Format(time.RFC3339))
+	fmt.Println("expires at :", expires)
+
+	if key == "" {
+		fmt.Println("signature  : not verified (no key)")
+		return
+	}
+	tokenKey, err := core.ParseTokenKey(key)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if _, err := core.VerifyToken(token, tokenKey); err != nil {
+		fmt.Println("signature  :", err.Error())
+		return
+	}
+	fmt.Println("signature  : valid")
+}
+
+// 解析过期时长，支持天（如 "7d"）及 time.ParseDuration 的格式，"0" 为不过期
+func parseExpire(expire string) (time.Duration, error) {
+	if expire == "0" {
+		return 0, nil
+	}
+	if days, found := strings.CutSuffix(expire, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("bad expire duration %s", expire)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(expire)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("bad expire duration %s", expire)
+	}
+	return duration, nil
+}
@@ -1,10 +1,9 @@
 package wan
 
 import (
+	"context"
 	"fmt"
-	"net"
 	"os"
-	"strings"
 	"tcp-tunnel/logger"
 
 	"github.com/yymmiinngg/goargs"
@@ -23,13 +22,54 @@ func Start(argsArr []string, log *logger.Logger) {
     Usage: {{COMMAND}} WAN {{OPTION}}
 
 	+ -b, --bind-address          # Listen on a port for client connecting and binding, 
-	#                               Like "0.0.0.0:3390" (Default: "0.0.0.0:3390")
+	#                               Like "0.0.0.0:3390" (Default: "0.0.0.0:3390"), or
+	#                               "kcp://0.0.0.0:3390" to accept LAN over KCP (UDP) for
+	#                               lossy links, the LAN uses a kcp:// server address too
 	+ -k, --handshake-key         # Handshake key used for binding connections to protect the
 	#                               server from unauthorized connection hijacking
+	+     --visit-key             # A separate key for the CLIENT side to visit secret bindings
+	#                               through the bind port instead of the handshake key, it
+	#                               can only visit, not bind or relay
+	+ -t, --token-key             # Require signed bind tokens from LAN (issued by the TOKEN
+	#                               mode): an HMAC secret, or an Ed25519 public key like
+	#                               "ed25519:<base64>", the handshake key (or tls) is still
+	#                               required to keep the token secret on the wire
 	+ -i, --io-timeout            # Read/Write Timeout Duration in relaying (Unit: Seconds,
 	#                               Default: 120)
+	+ -g, --grace-period          # Keep the open port for a while after the LAN binding
+	#                               is broken, the same LAN (or a LAN with a token for its
+	#                               client name) reconnecting takes over the port, users are
+	#                               refused meanwhile (Unit: Seconds, Default: 0, close
+	#                               immediately)
+	+ -B, --balance-policy        # Policy for spreading user connections when multiple LAN
+	#                               clients bind the same open port: round-robin, least-conn
+	#                               or weighted (Default: round-robin)
+	+ -r, --relay-ports           # Listen relay ports in this range, like "40000-40100"
+	#                               (Default: any free port)
+	+ -a, --relay-advertise       # The relay address told to the LAN when the WAN is behind
+	#                               NAT, a port-mapped load balancer or in a container, like
+	#                               "1.1.1.1", or "1.1.1.1:50000" when the relay port range is
+	#                               mapped from port 50000 ("-r" is required with a port)
+	?     --single-port           # Single-port mode, LAN relay connections also go through
+	#                               the bind port instead of random relay ports, so only the
+	#                               bind port needs to be open (older LANs still use relay
+	#                               ports)
+	+     --ban-failures          # Ban an IP for a while when it fails the handshake (or
+	#                               the bind token) this many times in 10 minutes on the bind,
+	#                               relay or websocket port (Default: 5, 0 to disable), it
+	#                               only slows down online guessing, use a long random key
+	+     --ban-time              # Duration of the first ban, doubled for each repeated ban
+	#                               (Unit: Seconds, Default: 600)
+	+     --ban-file              # Keep the bans in this file across restarts, list or unban
+	#                               them with the BAN mode
+	?     --legacy-handshake      # Use the old (version 1) handshake with older LAN and CLIENT
+	#                               versions, it can be replayed, upgrade all sides instead
 	+ -C, --tls-x509-certificate  # The Certificate of tls connection
 	+ -K, --tls-x509-key          # The private key of tls connection
+	+ -w, --ws-address            # Also accept LAN binding and relay connections over
+	#                               WebSocket on this address, like "0.0.0.0:8080" (wss when
+	#                               the tls certificate is set)
+	+ -W, --ws-path               # The HTTP path of the WebSocket service (Default: /tcprp)
 
     ? -H, --help                  # Show Help and Exit
 `
@@ -37,8 +77,18 @@ func Start(argsArr []string, log *logger.Logger) {
 	// 定义变量
 	var bindAddress string
 	var handshakeKey string
+	var visitKey string
+	var tokenKey string
 	var ioTimeout int
+	var gracePeriod int
+	var balancePolicy string
 	var tlsCertificate, tlsPrivateKey string
+	var webSocketAddress, webSocketPath string
+	var singlePort bool
+	var legacyHandshake bool
+	var banFailures, banTime int
+	var banFile string
+	var relayPorts, relayAdvertise string
 
 	// 编译模板
 	args, err := goargs.Compile(template)
@@ -51,9 +101,22 @@ func Start(argsArr []string, log *logger.Logger) {
 	// 绑定变量
 	args.StringOption("-b", &bindAddress, "0.0.0.0:3390")
 	args.IntOption("-i", &ioTimeout, 120)
+	args.IntOption("-g", &gracePeriod, 0)
+	args.StringOption("-B", &balancePolicy, BalancePolicyRoundRobin)
 	args.StringOption("-k", &handshakeKey, "")
+	args.StringOption("--visit-key", &visitKey, "")
+	args.StringOption("-t", &tokenKey, "")
 	args.StringOption("-C", &tlsCertificate, "")
 	args.StringOption("-K", &tlsPrivateKey, "")
+	args.StringOption("-r", &relayPorts, "")
+	args.StringOption("-a", &relayAdvertise, "")
+	args.BoolOption("--single-port", &singlePort, false)
+	args.BoolOption("--legacy-handshake", &legacyHandshake, false)
+	args.IntOption("--ban-failures", &banFailures, 5)
+	args.IntOption("--ban-time", &banTime, 600)
+	args.StringOption("--ban-file", &banFile, "")
+	args.StringOption("-w", &webSocketAddress, "")
+	args.StringOption("-W", &webSocketPath, "/tcprp")
 
 	// 处理参数
 	err = args.Parse(argsArr, goargs.AllowUnknowOption)
@@ -70,36 +133,33 @@ func Start(argsArr []string, log *logger.Logger) {
 		return
 	}
 
-	if ioTimeout == 0 {
-		fmt.Println("The io timeout duration cannot be less than 1")
-		return
-	}
-
-	// 自动拼接IP
-	if strings.HasPrefix(bindAddress, ":") {
-		bindAddress = "0.0.0.0" + bindAddress
-	}
-
-	// 提取tcp地址
-	bindAddr, err := net.ResolveTCPAddr("tcp", bindAddress)
+	// 创建服务
+	server, err := NewServer(Config{
+		BindAddress:      bindAddress,
+		HandshakeKey:     handshakeKey,
+		VisitKey:         visitKey,
+		TokenKey:         tokenKey,
+		IoTimeout:        ioTimeout,
+		GracePeriod:      gracePeriod,
+		BalancePolicy:    balancePolicy,
+		TlsCertificate:   tlsCertificate,
+		TlsPrivateKey:    tlsPrivateKey,
+		RelayPorts:       relayPorts,
+		RelayAdvertise:   relayAdvertise,
+		LegacyHandshake:  legacyHandshake,
+		BanFailures:      banFailures,
+		BanTime:          banTime,
+		BanFile:          banFile,
+		SinglePort:       singlePort,
+		WebSocketAddress: webSocketAddress,
+		WebSocketPath:    webSocketPath,
+		Log:              log,
+	})
 	if err != nil {
-		fmt.Println("resolve bind address error:", err.Error())
-		return
-	}
-
-	// 证书和密钥必须成对出现
-	if (tlsCertificate != "" && tlsPrivateKey == "") || (tlsCertificate == "" && tlsPrivateKey != "") {
-		fmt.Println("tls certificate and private key must be pair")
+		fmt.Println(err.Error())
 		return
 	}
 
 	// 启动服务
-	StartBindServer(
-		bindAddr,
-		ioTimeout,
-		handshakeKey,
-		log,
-		tlsCertificate,
-		tlsPrivateKey,
-	)
+	server.Run(context.Background())
 }
@@ -0,0 +1,77 @@
+package wan
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"tcp-tunnel/core"
+	nets "tcp-tunnel/net"
+)
+
+// WebSocketHandler 以WebSocket接受LAN的绑定连接及转发连接（参数relay为转发端口），
+// 可挂载到已有的Web服务上，如 mux.Handle("/tcprp", server.WebSocketHandler())
+func (it *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if it.isClosed() {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil && !it.guard.allow(addr) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		relay := r.URL.Query().Get("relay")
+		var member *relayMember
+		if relay != "" {
+			relayPort, err := strconv.Atoi(relay)
+			if err == nil {
+				member = it.findMemberByPort(relayPort)
+			}
+			if member == nil {
+				it.log.Debug("websocket relay port not found", relay, "<-", r.RemoteAddr)
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		conn, err := nets.AcceptWebSocket(w, r)
+		if err != nil {
+			it.log.Debug("accept websocket error:", err.Error())
+			return
+		}
+
+		// 转发连接
+		if member != nil {
+			member.putRelayConn(conn)
+			return
+		}
+		// 绑定连接
+		it.log.Debug("get a websocket bind connection", conn.LocalAddr().String(), "<-", conn.RemoteAddr().String())
+		it.handleBindConn(conn)
+	})
+}
+
+// 监听WebSocket端口，配置了TLS证书时为wss
+func (it *Server) listenWebSocket() (*http.Server, net.Listener, error) {
+	listener, err := net.Listen("tcp", it.webSocketAddress)
+	if err != nil {
+		it.log.Error(err, "listen websocket server error")
+		return nil, nil, &core.ListenError{Address: it.webSocketAddress, Err: err}
+	}
+	scheme := "ws"
+	if it.tlsCertificate != "" {
+		cert, err := tls.LoadX509KeyPair(it.tlsCertificate, it.tlsPrivateKey)
+		if err != nil {
+			listener.Close()
+			it.log.Error(err, "load x509 key pair error")
+			return nil, nil, err
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+		scheme = "wss"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(it.webSocketPath, it.WebSocketHandler())
+	it.log.Info("start websocket server at", scheme+"://"+listener.Addr().String()+it.webSocketPath)
+	return &http.Server{Handler: mux}, listener, nil
+}